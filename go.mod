@@ -0,0 +1,7 @@
+module github.com/muthuArivoli/mini-ping
+
+go 1.26.0
+
+require golang.org/x/net v0.59.0
+
+require golang.org/x/sys v0.48.0 // indirect
@@ -0,0 +1,142 @@
+package miniping
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// How long an -on-breach command or a -webhook call may take
+const alertTimeout = 10 * time.Second
+
+// Runs the -on-breach command and calls the -webhook with the stats once the
+// loss goes above -maxloss or the RTT above -maxrtt, and not again until both
+// were back within their limits. The alert runs in the background so pinging
+// carries on; wait holds up exiting until it is done.
+type breachAlerter struct {
+	mu      sync.Mutex
+	command string
+	webhook string
+	// -1 when loss isn't watched
+	maxLoss  int
+	breached bool
+	pending  sync.WaitGroup
+	// sends the alert, alert unless replaced
+	fire func(reason string, stats Stats)
+}
+
+func newBreachAlerter(command string, webhook string, maxLoss int) *breachAlerter {
+	a := &breachAlerter{command: command, webhook: webhook, maxLoss: maxLoss}
+	a.fire = a.alert
+	return a
+}
+
+// Checks stats of mp against the thresholds and fires on a new breach
+func (a *breachAlerter) check(mp *MiniPinger, stats Stats) {
+	reason := ""
+	if a.maxLoss >= 0 && !stats.LossUndefined && stats.Loss > a.maxLoss {
+		reason = fmt.Sprintf("loss %d%% above %d%%", stats.Loss, a.maxLoss)
+	} else if value, slow := mp.rttExceeded(stats); slow {
+		reason = fmt.Sprintf("%s rtt %.3f ms above %v", mp.maxRTTStat, value, mp.maxRTT)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if reason == "" {
+		a.breached = false
+		return
+	}
+	if a.breached {
+		return
+	}
+	a.breached = true
+	a.pending.Add(1)
+	go func() {
+		defer a.pending.Done()
+		a.fire(reason, stats)
+	}()
+}
+
+// Runs the command with the stats as JSON on stdin and the reason in
+// MINIPING_BREACH, and POSTs the stats to the webhook with the reason in the
+// X-Mini-Ping-Breach header. Failures are reported on stderr.
+func (a *breachAlerter) alert(reason string, stats Stats) {
+	stats.Packets = nil
+	body, err := json.Marshal(stats)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "alert failed: %v\n", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), alertTimeout)
+	defer cancel()
+	if a.command != "" {
+		cmd := exec.CommandContext(ctx, "sh", "-c", a.command)
+		cmd.Stdin = bytes.NewReader(body)
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		cmd.Env = append(os.Environ(), "MINIPING_BREACH="+reason)
+		if err := cmd.Run(); err != nil {
+			fmt.Fprintf(os.Stderr, "-on-breach command failed: %v\n", err)
+		}
+	}
+	if a.webhook != "" {
+		request, err := http.NewRequestWithContext(ctx, http.MethodPost, a.webhook, bytes.NewReader(body))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "-webhook failed: %v\n", err)
+			return
+		}
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("X-Mini-Ping-Breach", reason)
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "-webhook failed: %v\n", err)
+			return
+		}
+		response.Body.Close()
+		if response.StatusCode/100 != 2 {
+			fmt.Fprintf(os.Stderr, "-webhook failed: %s\n", response.Status)
+		}
+	}
+}
+
+// Waits for the alerts still running
+func (a *breachAlerter) wait() {
+	a.pending.Wait()
+}
+
+// Checks the thresholds every interval while a -monitor run goes on, on the
+// packets settled so far
+func (mp *MiniPinger) watchBreaches() {
+	ticker := time.NewTicker(mp.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-mp.finished:
+			return
+		case <-ticker.C:
+			mp.alerter.check(mp, settledStats(mp.stats()))
+		}
+	}
+}
+
+// Returns stats with the loss counted over the packets already answered or
+// timed out only, as the ones in flight aren't lost yet
+func settledStats(stats Stats) Stats {
+	pending := 0
+	for _, record := range stats.Packets {
+		if record.Status == statusPending {
+			pending++
+		}
+	}
+	if settled := stats.Sent - pending; settled > 0 {
+		stats.Loss = 100 - 100*stats.Received/settled
+	} else {
+		stats.Loss = 0
+	}
+	return stats
+}
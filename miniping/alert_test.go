@@ -0,0 +1,67 @@
+package miniping
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Each breach fires once, and a new one only after the run recovered
+func TestBreachAlerter(t *testing.T) {
+	mp := testPinger("192.0.2.1")
+	mp.maxRTT = 100 * time.Millisecond
+	mp.maxRTTStat = rttStatAvg
+	a := newBreachAlerter("", "", 10)
+	var fired []string
+	a.fire = func(reason string, stats Stats) {
+		fired = append(fired, reason)
+	}
+	for _, stats := range []Stats{
+		{Received: 10, Loss: 20},
+		{Received: 10, Loss: 30},
+		{Received: 10, Loss: 0, AvgRTT: 20},
+		{Received: 10, Loss: 0, AvgRTT: 150},
+		{LossUndefined: true},
+		{Received: 10, Loss: 50},
+	} {
+		a.check(mp, stats)
+		a.wait()
+	}
+	want := []string{"loss 20% above 10%", "avg rtt 150.000 ms above 100ms", "loss 50% above 10%"}
+	if !reflect.DeepEqual(fired, want) {
+		t.Errorf("fired %q, want %q", fired, want)
+	}
+}
+
+// The webhook gets the stats as JSON and the reason in a header
+func TestBreachWebhook(t *testing.T) {
+	type call struct {
+		reason string
+		stats  Stats
+	}
+	calls := make(chan call, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var c call
+		c.reason = r.Header.Get("X-Mini-Ping-Breach")
+		if err := json.NewDecoder(r.Body).Decode(&c.stats); err != nil {
+			t.Error(err)
+		}
+		calls <- c
+	}))
+	defer server.Close()
+	mp := testPinger("192.0.2.1")
+	a := newBreachAlerter("", server.URL, 10)
+	a.check(mp, Stats{Sent: 10, Received: 5, Loss: 50})
+	a.wait()
+	select {
+	case c := <-calls:
+		if c.reason != "loss 50% above 10%" || c.stats.Sent != 10 || c.stats.Loss != 50 {
+			t.Errorf("webhook called with %q and %+v", c.reason, c.stats)
+		}
+	default:
+		t.Error("the webhook wasn't called")
+	}
+}
@@ -0,0 +1,508 @@
+package miniping
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// The outcome of one pinger of a multi-destination run, as handed to the collector
+type hostResult struct {
+	host  string
+	stats Stats
+	err   error
+}
+
+// Pings every target at the same time. Each pinger reports its outcome to a
+// collector over a channel once done, rather than printing its own summary;
+// the results come back in the order the pingers finished.
+func pingConcurrently(targets []string, newPinger func(string) (*MiniPinger, error), interrupted chan bool) []hostResult {
+	// room for all of them, so that the ones failing to start can be
+	// collected right away
+	collector := make(chan hostResult, len(targets))
+	for _, target := range targets {
+		mp, err := newPinger(target)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", target, err)
+			collector <- hostResult{host: target, err: err}
+			continue
+		}
+		go func(target string, mp *MiniPinger) {
+			collector <- pingTarget(target, mp, interrupted)
+		}(target, mp)
+	}
+	results := make([]hostResult, 0, len(targets))
+	for range targets {
+		results = append(results, <-collector)
+	}
+	return results
+}
+
+// Runs one pinger of a multi-destination run to the end
+func pingTarget(target string, mp *MiniPinger, interrupted chan bool) hostResult {
+	mp.interrupted = interrupted
+	go mp.stopWhenClosed(interrupted)
+	err := mp.Run()
+	if errors.Is(err, ErrTimeout) {
+		// reported as 100% loss
+		err = nil
+	}
+	return hostResult{host: target, stats: mp.stats(), err: err}
+}
+
+// Returns the exit code of a multi-destination run: an error in any pinger
+// wins, otherwise a single destination answering is a success
+func multiExitCode(results []hostResult) int {
+	code := exitNoReplies
+	for _, result := range results {
+		if result.err != nil {
+			return exitError
+		}
+		if result.stats.Received > 0 {
+			code = exitSuccess
+		}
+	}
+	return code
+}
+
+// Pings every host given at the same time and prints one summary table,
+// sorted by host, once they are all done. Returns the exit code.
+func pingHosts(hosts []string, newPinger func(string) (*MiniPinger, error), interrupted chan bool) int {
+	results := pingConcurrently(hosts, newPinger, interrupted)
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].host < results[j].host
+	})
+	fmt.Printf("%-40s %6s %6s %6s %12s\n", "host", "sent", "recv", "loss", "avg rtt")
+	for _, r := range results {
+		fmt.Printf("%-40s %6d %6d %6s %12s\n",
+			r.host, r.stats.Sent, r.stats.Received, formatLoss(r.stats), formatAvgRTT(r.stats))
+	}
+	return multiExitCode(results)
+}
+
+// Pings every address of a CIDR range, at most workers at a time, and prints
+// whether each one answered as soon as it is done, so that a large range
+// streams its results instead of holding on to all of them. Returns the exit
+// code.
+func pingRange(network *net.IPNet, workers int, newPinger func(string) (*MiniPinger, error), interrupted chan bool) int {
+	type job struct {
+		target string
+		mp     *MiniPinger
+		// why the pinger couldn't be created, if it couldn't
+		err error
+	}
+	jobs := make(chan job)
+	go func() {
+		defer close(jobs)
+		for ip := firstHost(network); network.Contains(ip) && !isBroadcast(ip, network); ip = nextIP(ip) {
+			target := ip.String()
+			mp, err := newPinger(target)
+			select {
+			case jobs <- job{target, mp, err}:
+			case <-interrupted:
+				return
+			}
+		}
+	}()
+	results := make(chan hostResult)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				if j.err != nil {
+					results <- hostResult{host: j.target, err: j.err}
+					continue
+				}
+				results <- pingTarget(j.target, j.mp, interrupted)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	up, total, code := 0, 0, exitNoReplies
+	for result := range results {
+		total++
+		switch {
+		case result.err != nil:
+			fmt.Printf("%-40s error: %v\n", result.host, result.err)
+			code = exitError
+		case result.stats.Received > 0:
+			fmt.Printf("%-40s up   %s\n", result.host, formatAvgRTT(result.stats))
+			up++
+		default:
+			fmt.Printf("%-40s down\n", result.host)
+		}
+	}
+	fmt.Printf("%d of %d addresses up\n", up, total)
+	if code != exitError && up > 0 {
+		code = exitSuccess
+	}
+	return code
+}
+
+// Returns the first host address of network, skipping the network address of
+// an IPv4 range that has one
+func firstHost(network *net.IPNet) net.IP {
+	ip := network.IP.Mask(network.Mask)
+	if ones, bits := network.Mask.Size(); bits == 32 && ones < 31 {
+		return nextIP(ip)
+	}
+	return ip
+}
+
+// Reports whether ip is the broadcast address of an IPv4 range that has one
+func isBroadcast(ip net.IP, network *net.IPNet) bool {
+	ones, bits := network.Mask.Size()
+	if bits != 32 || ones >= 31 {
+		return false
+	}
+	ip4 := ip.To4()
+	for i, b := range network.Mask {
+		if ip4[i]|b != 0xff {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the address following ip, wrapping round to zero after the last one
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// Pings every address host resolves to at the same time, then ranks the
+// addresses by how they responded. Returns the exit code.
+func pingAll(host string, resolveTimeout time.Duration, newPinger func(string) (*MiniPinger, error), interrupted chan bool) int {
+	ctx, cancel := resolveContext(resolveTimeout)
+	defer cancel()
+	addresses, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR encountered:", err)
+		return exitError
+	}
+	targets := make([]string, len(addresses))
+	for i, address := range addresses {
+		targets[i] = address.String()
+	}
+	results := pingConcurrently(targets, newPinger, interrupted)
+	printAddressRanking(results)
+	return multiExitCode(results)
+}
+
+// Pings the first IPv4 and the first IPv6 address of host at the same time
+// and compares the two stacks side by side. A host with only one family is
+// pinged over that one. Returns the exit code.
+func pingDual(host string, resolveTimeout time.Duration, newPinger func(string) (*MiniPinger, error), interrupted chan bool) int {
+	ctx, cancel := resolveContext(resolveTimeout)
+	defer cancel()
+	addresses, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR encountered:", err)
+		return exitError
+	}
+	var ipv4Address, ipv6Address string
+	for _, address := range addresses {
+		if address.IP.To4() != nil && ipv4Address == "" {
+			ipv4Address = address.String()
+		} else if address.IP.To4() == nil && ipv6Address == "" {
+			ipv6Address = address.String()
+		}
+	}
+	var targets []string
+	for _, family := range []struct{ name, address string }{{"IPv4", ipv4Address}, {"IPv6", ipv6Address}} {
+		if family.address == "" {
+			fmt.Printf("%s has no %s address, only the other family is pinged\n", host, family.name)
+			continue
+		}
+		targets = append(targets, family.address)
+	}
+	results := pingConcurrently(targets, newPinger, interrupted)
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].host == ipv4Address && results[j].host != ipv4Address
+	})
+	fmt.Printf("%-6s %-40s %6s %12s\n", "family", "address", "loss", "avg rtt")
+	for _, r := range results {
+		family := "IPv6"
+		if r.host == ipv4Address {
+			family = "IPv4"
+		}
+		fmt.Printf("%-6s %-40s %6s %12s\n", family, r.host, formatLoss(r.stats), formatAvgRTT(r.stats))
+	}
+	return multiExitCode(results)
+}
+
+// Pings two hosts at the same time and prints their stats side by side, with
+// the differences and the host that did better. Returns the exit code.
+func pingCompare(hosts []string, newPinger func(string) (*MiniPinger, error), interrupted chan bool) int {
+	results := pingConcurrently(hosts, newPinger, interrupted)
+	// back in the order given, the first host is A
+	if results[0].host != hosts[0] {
+		results[0], results[1] = results[1], results[0]
+	}
+	printComparison(results[0], results[1])
+	return multiExitCode(results)
+}
+
+// Prints the -compare table of a and b and the verdict
+func printComparison(a, b hostResult) {
+	fmt.Printf("%-10s %-20s %-20s %s\n", "", a.host, b.host, "difference (B - A)")
+	fmt.Printf("%-10s %-20d %-20d %+d\n", "sent", a.stats.Sent, b.stats.Sent, b.stats.Sent-a.stats.Sent)
+	fmt.Printf("%-10s %-20d %-20d %+d\n", "received", a.stats.Received, b.stats.Received, b.stats.Received-a.stats.Received)
+	fmt.Printf("%-10s %-20s %-20s %+d points\n", "loss", formatLoss(a.stats), formatLoss(b.stats),
+		b.stats.Loss-a.stats.Loss)
+	for _, row := range []struct {
+		name  string
+		value func(Stats) float64
+	}{
+		{"min rtt", func(s Stats) float64 { return s.MinRTT }},
+		{"avg rtt", func(s Stats) float64 { return s.AvgRTT }},
+		{"max rtt", func(s Stats) float64 { return s.MaxRTT }},
+	} {
+		difference := "-"
+		if a.stats.Received > 0 && b.stats.Received > 0 {
+			difference = fmt.Sprintf("%+.3f ms", row.value(b.stats)-row.value(a.stats))
+		}
+		fmt.Printf("%-10s %-20s %-20s %s\n", row.name, formatRTTValue(a.stats, row.value), formatRTTValue(b.stats, row.value),
+			difference)
+	}
+	winner, reason := compareStats(a.stats, b.stats)
+	switch winner {
+	case 0:
+		fmt.Printf("winner: %s, %s\n", a.host, reason)
+	case 1:
+		fmt.Printf("winner: %s, %s\n", b.host, reason)
+	default:
+		fmt.Printf("no winner, %s\n", reason)
+	}
+}
+
+// Returns an RTT statistic for the -compare table, or a dash when nothing was answered
+func formatRTTValue(stats Stats, value func(Stats) float64) string {
+	if stats.Received == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.3f ms", value(stats))
+}
+
+// Decides which of two hosts did better: the one with less loss, and at equal
+// loss the one with the lower average RTT. Returns 0 for a, 1 for b or -1 for
+// a tie, and why.
+func compareStats(a, b Stats) (int, string) {
+	switch {
+	case a.Received == 0 && b.Received == 0:
+		return -1, "neither answered"
+	case b.Received == 0:
+		return 0, "the other didn't answer"
+	case a.Received == 0:
+		return 1, "the other didn't answer"
+	case a.Loss != b.Loss:
+		winner := 0
+		if b.Loss < a.Loss {
+			winner = 1
+		}
+		return winner, fmt.Sprintf("%d points less loss", int(math.Abs(float64(a.Loss-b.Loss))))
+	case a.AvgRTT != b.AvgRTT:
+		winner := 0
+		if b.AvgRTT < a.AvgRTT {
+			winner = 1
+		}
+		return winner, fmt.Sprintf("same loss, %.3f ms lower average rtt", math.Abs(a.AvgRTT-b.AvgRTT))
+	}
+	return -1, "same loss and average rtt"
+}
+
+// Pings host and the default gateway of its address family at the same time
+// and compares them, to tell latency on the local network from latency
+// further upstream. Returns the exit code, which only depends on host.
+func pingWithGateway(host string, resolveTimeout time.Duration, newPinger func(string) (*MiniPinger, error), interrupted chan bool) int {
+	// the address a plain run would ping, IPv4 first
+	address, err := resolveIPAddr(host, resolveTimeout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR encountered:", err)
+		return exitError
+	}
+	target := address.String()
+	gateway, err := defaultGateway(address.IP.To4() == nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR encountered:", err)
+		return exitError
+	}
+	results := pingConcurrently([]string{gateway, target}, newPinger, interrupted)
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].host == gateway && results[j].host != gateway
+	})
+	fmt.Printf("%-8s %-40s %6s %12s\n", "hop", "address", "loss", "avg rtt")
+	var gatewayStats, targetStats Stats
+	code := exitNoReplies
+	for _, r := range results {
+		hop := "target"
+		if r.host == gateway {
+			hop = "gateway"
+			gatewayStats = r.stats
+		} else {
+			targetStats = r.stats
+			if r.err != nil {
+				code = exitError
+			} else if r.stats.Received > 0 {
+				code = exitSuccess
+			}
+		}
+		fmt.Printf("%-8s %-40s %6s %12s\n", hop, r.host, formatLoss(r.stats), formatAvgRTT(r.stats))
+	}
+	if gatewayStats.Received > 0 && targetStats.Received > 0 && targetStats.AvgRTT > 0 {
+		fmt.Printf("the local network accounts for %.0f%% of the average rtt\n",
+			100*math.Min(gatewayStats.AvgRTT/targetStats.AvgRTT, 1))
+	}
+	return code
+}
+
+// Returns the address of the default gateway for IPv4, or for IPv6 when
+// ipv6 is set, from the kernel's routing table. Only Linux is supported.
+var defaultGateway = func(ipv6 bool) (string, error) {
+	if runtime.GOOS != "linux" {
+		return "", fmt.Errorf("finding the default gateway needs Linux, not %s", runtime.GOOS)
+	}
+	path, parse := "/proc/net/route", parseRouteTable
+	if ipv6 {
+		path, parse = "/proc/net/ipv6_route", parseIPv6RouteTable
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	gateway, err := parse(file)
+	if err != nil {
+		return "", err
+	}
+	if gateway == "" {
+		return "", fmt.Errorf("no default route in %s", path)
+	}
+	return gateway, nil
+}
+
+// The byte order of this host, which the kernel writes the addresses of
+// /proc/net/route in
+var hostByteOrder binary.ByteOrder = func() binary.ByteOrder {
+	probe := uint16(1)
+	if *(*byte)(unsafe.Pointer(&probe)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// Returns the gateway of the default route in the format of /proc/net/route,
+// or an empty string if there is none. Addresses in it are hex numbers in host
+// byte order, so on the little-endian hosts Linux mostly runs on the bytes come reversed.
+func parseRouteTable(r io.Reader) (string, error) {
+	scanner := bufio.NewScanner(r)
+	// the first line holds the column names
+	scanner.Scan()
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags RefCnt Use Metric Mask ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 || fields[1] != "00000000" || fields[7] != "00000000" {
+			continue
+		}
+		gateway, err := strconv.ParseUint(fields[2], 16, 32)
+		if err != nil || gateway == 0 {
+			continue
+		}
+		ip := make(net.IP, net.IPv4len)
+		hostByteOrder.PutUint32(ip, uint32(gateway))
+		return ip.String(), nil
+	}
+	return "", scanner.Err()
+}
+
+// Returns the gateway of the default route in the format of
+// /proc/net/ipv6_route, or an empty string if there is none. A link-local
+// gateway gets the zone of its interface.
+func parseIPv6RouteTable(r io.Reader) (string, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// destination, prefix length, source, prefix length, next hop, metric, refcnt, use, flags, device
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || fields[1] != "00" || strings.Trim(fields[0], "0") != "" {
+			continue
+		}
+		nextHop, err := hex.DecodeString(fields[4])
+		if err != nil || len(nextHop) != net.IPv6len || net.IP(nextHop).IsUnspecified() {
+			continue
+		}
+		ip := net.IP(nextHop)
+		if ip.IsLinkLocalUnicast() {
+			return ip.String() + "%" + fields[9], nil
+		}
+		return ip.String(), nil
+	}
+	return "", scanner.Err()
+}
+
+// Prints one line per address of a -all run, most responsive first: the
+// address that answered first in the most rounds leads, ties go to lower loss
+// and then to the lower average RTT
+func printAddressRanking(results []hostResult) {
+	firsts := make([]int, len(results))
+	// the fastest reply of each round, by sequence number
+	fastest := make(map[int]int)
+	for i, result := range results {
+		for _, record := range result.stats.Packets {
+			if record.Status != statusReplied {
+				continue
+			}
+			winner, ok := fastest[record.Seq]
+			if !ok || record.RTT < results[winner].stats.Packets[record.Seq].RTT {
+				fastest[record.Seq] = i
+			}
+		}
+	}
+	for _, winner := range fastest {
+		firsts[winner]++
+	}
+	order := make([]int, len(results))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := order[i], order[j]
+		if firsts[a] != firsts[b] {
+			return firsts[a] > firsts[b]
+		}
+		if results[a].stats.Loss != results[b].stats.Loss {
+			return results[a].stats.Loss < results[b].stats.Loss
+		}
+		return results[a].stats.AvgRTT < results[b].stats.AvgRTT
+	})
+	fmt.Printf("%-40s %6s %6s %6s %12s %8s\n", "address", "sent", "recv", "loss", "avg rtt", "first")
+	for _, i := range order {
+		r := results[i]
+		fmt.Printf("%-40s %6d %6d %6s %12s %8d\n",
+			r.host, r.stats.Sent, r.stats.Received, formatLoss(r.stats), formatAvgRTT(r.stats), firsts[i])
+	}
+}
@@ -0,0 +1,227 @@
+package miniping
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Returns a newPinger for the multi-destination runs whose pingers talk to
+// fake conns answering for the addresses in up, and the pingers it made by
+// target. Creating a pinger for a target in fail fails.
+func fakePingers(up []string, fail ...string) (func(string) (*MiniPinger, error), map[string]*MiniPinger, *sync.Mutex) {
+	var mu sync.Mutex
+	made := make(map[string]*MiniPinger)
+	newPinger := func(target string) (*MiniPinger, error) {
+		for _, failing := range fail {
+			if target == failing {
+				return nil, fmt.Errorf("cannot ping %s", target)
+			}
+		}
+		mp := testPinger(target)
+		mp.stdout = io.Discard
+		mp.open = func() (icmpConn, string, error) {
+			// closed by run
+			conn, err := openFakeConn(up...)
+			if err != nil {
+				return nil, "", err
+			}
+			return conn, modeRaw, nil
+		}
+		mu.Lock()
+		made[target] = mp
+		mu.Unlock()
+		return mp, nil
+	}
+	return newPinger, made, &mu
+}
+
+// Sweeps a small range with fake conns and checks every host address was
+// pinged once and the ones answering were found
+func TestPingRange(t *testing.T) {
+	tests := []struct {
+		cidr  string
+		up    []string
+		hosts []string
+		want  int
+	}{
+		{"192.0.2.0/29", []string{"192.0.2.2", "192.0.2.5"},
+			[]string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4", "192.0.2.5", "192.0.2.6"}, exitSuccess},
+		{"192.0.2.8/31", nil, []string{"192.0.2.8", "192.0.2.9"}, exitNoReplies},
+		{"192.0.2.7/32", []string{"192.0.2.7"}, []string{"192.0.2.7"}, exitSuccess},
+	}
+	for _, tt := range tests {
+		_, network, err := net.ParseCIDR(tt.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		newPinger, made, mu := fakePingers(tt.up)
+		if got := pingRange(network, 3, newPinger, make(chan bool)); got != tt.want {
+			t.Errorf("%s: exit code %d, want %d", tt.cidr, got, tt.want)
+		}
+		mu.Lock()
+		if len(made) != len(tt.hosts) {
+			t.Errorf("%s: pinged %d addresses, want %d", tt.cidr, len(made), len(tt.hosts))
+		}
+		up := make(map[string]bool)
+		for _, address := range tt.up {
+			up[address] = true
+		}
+		for _, host := range tt.hosts {
+			mp := made[host]
+			if mp == nil {
+				t.Errorf("%s: %s not pinged", tt.cidr, host)
+				continue
+			}
+			if answered := mp.stats().Received > 0; answered != up[host] {
+				t.Errorf("%s: %s answered %v, want %v", tt.cidr, host, answered, up[host])
+			}
+		}
+		mu.Unlock()
+	}
+}
+
+// A pinger that can't be created fails the sweep, but the rest of the range
+// is still pinged
+func TestPingRangeCreateError(t *testing.T) {
+	_, network, err := net.ParseCIDR("192.0.2.0/30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newPinger, made, mu := fakePingers([]string{"192.0.2.1"}, "192.0.2.2")
+	if got := pingRange(network, 2, newPinger, make(chan bool)); got != exitError {
+		t.Errorf("exit code %d, want %d", got, exitError)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if mp := made["192.0.2.1"]; mp == nil || mp.stats().Received == 0 {
+		t.Error("192.0.2.1 wasn't pinged")
+	}
+}
+
+func TestParseRouteTable(t *testing.T) {
+	// addresses as the kernel writes them, in host byte order
+	hexAddress := func(address string) string {
+		return fmt.Sprintf("%08X", hostByteOrder.Uint32(net.ParseIP(address).To4()))
+	}
+	header := "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n"
+	subnet := "eth0\t" + hexAddress("192.168.1.0") + "\t00000000\t0001\t0\t0\t0\t" + hexAddress("255.255.255.0") + "\t0\t0\t0\n"
+	tests := []struct {
+		name  string
+		table string
+		want  string
+	}{
+		{"default route", header + subnet + "eth0\t00000000\t" + hexAddress("192.168.1.254") + "\t0003\t0\t0\t100\t00000000\t0\t0\t0\n", "192.168.1.254"},
+		{"no default route", header + subnet, ""},
+		{"default route without a gateway", header + "tun0\t00000000\t00000000\t0001\t0\t0\t0\t00000000\t0\t0\t0\n", ""},
+		{"empty", "", ""},
+	}
+	for _, tt := range tests {
+		got, err := parseRouteTable(strings.NewReader(tt.table))
+		if err != nil || got != tt.want {
+			t.Errorf("%s: gateway %q (%v), want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseIPv6RouteTable(t *testing.T) {
+	const any = "00000000000000000000000000000000 00 00000000000000000000000000000000 00 "
+	tests := []struct {
+		name  string
+		table string
+		want  string
+	}{
+		{"global gateway", any + "20010db8000000000000000000000001 00000400 00000001 00000000 00000003 eth0\n", "2001:db8::1"},
+		{"link-local gateway", any + "fe800000000000000000000000000001 00000400 00000001 00000000 00000003 eth0\n", "fe80::1%eth0"},
+		{"no gateway", any + "00000000000000000000000000000000 00000400 00000001 00000000 00000001 lo\n", ""},
+		{"no default route", "20010db8000000000000000000000000 40 00000000000000000000000000000000 00 " +
+			"00000000000000000000000000000000 00000100 00000001 00000000 00000001 eth0\n", ""},
+	}
+	for _, tt := range tests {
+		got, err := parseIPv6RouteTable(strings.NewReader(tt.table))
+		if err != nil || got != tt.want {
+			t.Errorf("%s: gateway %q (%v), want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestPingWithGateway(t *testing.T) {
+	defer func(found func(bool) (string, error)) {
+		defaultGateway = found
+	}(defaultGateway)
+	tests := []struct {
+		name    string
+		gateway string
+		err     error
+		up      []string
+		want    int
+	}{
+		{"both answer", "192.0.2.254", nil, []string{"192.0.2.254", "192.0.2.1"}, exitSuccess},
+		{"only the gateway answers", "192.0.2.254", nil, []string{"192.0.2.254"}, exitNoReplies},
+		{"no default route", "", errors.New("no default route in /proc/net/route"), nil, exitError},
+	}
+	for _, tt := range tests {
+		defaultGateway = func(ipv6 bool) (string, error) {
+			if ipv6 {
+				t.Errorf("%s: asked for the IPv6 gateway of an IPv4 destination", tt.name)
+			}
+			return tt.gateway, tt.err
+		}
+		newPinger, made, _ := fakePingers(tt.up)
+		if got := pingWithGateway("192.0.2.1", time.Second, newPinger, make(chan bool)); got != tt.want {
+			t.Errorf("%s: exit code %d, want %d", tt.name, got, tt.want)
+		}
+		if tt.err == nil && (made["192.0.2.254"] == nil || made["192.0.2.1"] == nil) {
+			t.Errorf("%s: pinged %v, want the gateway and the destination", tt.name, made)
+		}
+	}
+}
+
+// The host with less loss wins, and at equal loss the faster one
+func TestCompareStats(t *testing.T) {
+	tests := []struct {
+		name   string
+		a, b   Stats
+		winner int
+		reason string
+	}{
+		{"less loss", Stats{Received: 9, Loss: 10, AvgRTT: 5}, Stats{Received: 10, Loss: 0, AvgRTT: 20}, 1, "10 points less loss"},
+		{"faster", Stats{Received: 10, AvgRTT: 12.5}, Stats{Received: 10, AvgRTT: 20}, 0, "same loss, 7.500 ms lower average rtt"},
+		{"tie", Stats{Received: 10, AvgRTT: 20}, Stats{Received: 10, AvgRTT: 20}, -1, "same loss and average rtt"},
+		{"one unreachable", Stats{Loss: 100}, Stats{Received: 1, Loss: 90, AvgRTT: 300}, 1, "the other didn't answer"},
+		{"both unreachable", Stats{Loss: 100}, Stats{Loss: 100}, -1, "neither answered"},
+	}
+	for _, tt := range tests {
+		if winner, reason := compareStats(tt.a, tt.b); winner != tt.winner || reason != tt.reason {
+			t.Errorf("%s: winner %d, %q, want %d, %q", tt.name, winner, reason, tt.winner, tt.reason)
+		}
+	}
+}
+
+// A destination that doesn't answer, or can't even be pinged, still gets
+// compared with the other
+func TestPingCompare(t *testing.T) {
+	tests := []struct {
+		name     string
+		up, fail []string
+		want     int
+	}{
+		{"both answer", []string{"192.0.2.1", "192.0.2.2"}, nil, exitSuccess},
+		{"one answers", []string{"192.0.2.2"}, nil, exitSuccess},
+		{"one can't be pinged", []string{"192.0.2.2"}, []string{"192.0.2.1"}, exitError},
+	}
+	for _, tt := range tests {
+		newPinger, made, _ := fakePingers(tt.up, tt.fail...)
+		if got := pingCompare([]string{"192.0.2.1", "192.0.2.2"}, newPinger, make(chan bool)); got != tt.want {
+			t.Errorf("%s: exit code %d, want %d", tt.name, got, tt.want)
+		}
+		if made["192.0.2.2"] == nil {
+			t.Errorf("%s: B wasn't pinged", tt.name)
+		}
+	}
+}
@@ -0,0 +1,869 @@
+package miniping
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
+)
+
+// Exit codes of the command
+const (
+	exitSuccess   = 0
+	exitNoReplies = 1
+	exitError     = 2
+	exitDeadline  = 3
+	exitSlow      = 4
+	exitHops      = 5
+	// as shells report a process killed by SIGINT
+	exitAborted = 130
+)
+
+// Parses the comma-separated addresses of -reply-sources
+func parseReplySources(list string) ([]net.IP, error) {
+	var addresses []net.IP
+	for _, field := range strings.Split(list, ",") {
+		ip := net.ParseIP(strings.TrimSpace(field))
+		if ip == nil {
+			return nil, fmt.Errorf("-reply-sources: %q is not an IP address", field)
+		}
+		addresses = append(addresses, ip)
+	}
+	return addresses, nil
+}
+
+// What the first Ctrl-C does, see -on-signal
+const (
+	signalSummary   = "summary"
+	signalImmediate = "immediate"
+)
+
+// Turns signals into the shutdown of the run: the first one closes interrupted
+// so the run winds down, drains if asked to and prints its summary, and a
+// second one, for when that takes too long, calls abort. With immediate the
+// first one already aborts.
+func handleSignals(signals <-chan os.Signal, interrupted chan bool, immediate bool, abort func()) {
+	<-signals
+	if immediate {
+		abort()
+		return
+	}
+	close(interrupted)
+	<-signals
+	fmt.Fprintln(os.Stderr, "interrupted again, exiting without a summary")
+	abort()
+}
+
+// Stops the run with stopInterrupted once interrupted is closed
+func (mp *MiniPinger) stopWhenClosed(interrupted chan bool) {
+	select {
+	case <-interrupted:
+		mp.stop(stopInterrupted)
+	case <-mp.finished:
+	}
+}
+
+// Returns the exit code for a finished run: total loss wins over a deadline
+// that cut the requested count short
+func (mp *MiniPinger) exitCode(stats Stats) int {
+	if mp.runErr != nil {
+		return exitError
+	}
+	if mp.dryRun {
+		return exitSuccess
+	}
+	if stats.Received == 0 && !mp.fireAndForget {
+		return exitNoReplies
+	}
+	if _, slow := mp.rttExceeded(stats); slow {
+		return exitSlow
+	}
+	// a path that can't be told, as when a -ttl-sweep never reaches the
+	// destination, doesn't pass the check either
+	if hops, _, ok := mp.hopCount(stats); mp.expectHops >= 0 && (!ok || hops != mp.expectHops) {
+		return exitHops
+	}
+	if stats.StopReason == stopDeadline && mp.hasCount() && stats.Sent < mp.count {
+		return exitDeadline
+	}
+	return exitSuccess
+}
+
+// Parses a byte count such as 1500, 64K, 1M or 2G; the suffixes are powers of 1024
+func parseByteSize(value string) (int64, error) {
+	multiplier := int64(1)
+	digits := value
+	if len(value) > 0 {
+		switch value[len(value)-1] {
+		case 'k', 'K':
+			multiplier = 1 << 10
+		case 'm', 'M':
+			multiplier = 1 << 20
+		case 'g', 'G':
+			multiplier = 1 << 30
+		}
+	}
+	if multiplier > 1 {
+		digits = value[:len(value)-1]
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid byte count %q, expected e.g. 1500, 64K or 1M", value)
+	}
+	return n * multiplier, nil
+}
+
+// The flags that take a default from the environment, with the variable name
+// of the single-letter ones; the others use their own name, e.g.
+// MINIPING_TTL_SWEEP for -ttl-sweep. Flags that run commands or write files,
+// such as -on-breach or -pcap, are left out on purpose.
+var envFlagNames = map[string]string{
+	"c":               "COUNT",
+	"t":               "TTL",
+	"i":               "INTERVAL",
+	"s":               "SIZE",
+	"W":               "TIMEOUT",
+	"w":               "DEADLINE",
+	"Q":               "TOS",
+	"q":               "QUIET",
+	"v":               "VERBOSE",
+	"n":               "NUMERIC",
+	"ttl-sweep":       "",
+	"probes-per-hop":  "",
+	"expect-ttl":      "",
+	"expect-hops":     "",
+	"resolve-timeout": "",
+	"reresolve":       "",
+	"maxrtt":          "",
+	"maxrtt-stat":     "",
+	"maxloss":         "",
+	"jitter":          "",
+	"hist":            "",
+	"bufsize":         "",
+	"rcvbuf":          "",
+	"drain":           "",
+	"report":          "",
+	"flush":           "",
+	"tcp":             "",
+	"udp":             "",
+	"randid":          "",
+}
+
+// Returns the environment variable that gives flag name its default, or ""
+// if it takes none
+func envVariable(name string) string {
+	envName, ok := envFlagNames[name]
+	if !ok {
+		return ""
+	}
+	if envName == "" {
+		envName = strings.ToUpper(strings.Replace(name, "-", "_", -1))
+	}
+	return "MINIPING_" + envName
+}
+
+// Sets the flags of fs that take a default from the environment and weren't
+// given on the command line from their variable, as looked up by lookup,
+// parsing it like the flag itself. Returns the flags it set.
+func applyEnvDefaults(fs *flag.FlagSet, lookup func(string) (string, bool)) (map[string]bool, error) {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	fromEnv := make(map[string]bool)
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		variable := envVariable(f.Name)
+		if given[f.Name] || variable == "" || err != nil {
+			return
+		}
+		value, ok := lookup(variable)
+		if !ok {
+			return
+		}
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid value %q for %s: %v", value, variable, setErr)
+			return
+		}
+		fromEnv[f.Name] = true
+	})
+	return fromEnv, err
+}
+
+// Takes the flags in set that got their value from the environment, as listed
+// in fromEnv, back to their default when they conflict with a flag given on
+// the command line, which wins, and returns set without them
+func dropConflictingEnvDefaults(fs *flag.FlagSet, set map[string]bool, fromEnv map[string]bool) map[string]bool {
+	for _, conflict := range flagConflicts {
+		for _, other := range conflict.others {
+			a, b := conflict.flag, other
+			if !set[a] || !set[b] || fromEnv[a] == fromEnv[b] {
+				continue
+			}
+			if fromEnv[b] {
+				a = b
+			}
+			fs.Set(a, fs.Lookup(a).DefValue)
+			delete(set, a)
+		}
+	}
+	return set
+}
+
+// Flags that would otherwise be silently ignored or fight each other: flag
+// can't be given together with any of others, for reason
+var flagConflicts = []struct {
+	flag   string
+	others []string
+	reason string
+}{
+	{"for", []string{"c", "w"}, "-for replaces -c and -w"},
+	{"q", []string{"v", "quiet-errors"}, "-q prints only the summary"},
+	{"tcp", []string{"udp"}, "a run probes with one protocol"},
+	{"via", []string{"tcp", "ipid", "gateway", "all", "dual", "compare", "sweep"}, "-via source routes the packets of the one ICMP or -udp socket of a run"},
+	{"bytes", []string{"tcp"}, "-bytes counts ICMP and -udp packets"},
+	{"ttl-sweep", []string{"tcp", "udp"}, "-ttl-sweep only works with ICMP echoes"},
+	{"hwtime", []string{"tcp"}, "-hwtime times ICMP replies"},
+	{"redundancy", []string{"tcp", "udp"}, "-redundancy only copies ICMP packets"},
+	{"ts", []string{"payload-file", "tcp", "udp"}, "-ts sends ICMP timestamp requests instead of echoes"},
+	{"pattern", []string{"payload-file", "ts", "tcp", "udp"}, "-pattern fills the payload of ICMP echoes"},
+	{"max-outstanding", []string{"fire-and-forget"}, "-max-outstanding needs replies"},
+	{"stream-stats", []string{"hist", "ttl-sweep", "all", "ts"}, "-stream-stats doesn't keep the packets they need"},
+	{"avg-only", []string{"jsonl", "monitor", "all", "dual", "sweep"}, "-avg-only prints the average of one destination"},
+	{"all", []string{"loop", "pcap"}, "-all pings every address at once"},
+	{"dual", []string{"all", "loop", "pcap"}, "-dual pings two addresses at once"},
+	{"sweep", []string{"all", "dual", "loop", "pcap"}, "-sweep pings a whole range at once"},
+	{"ipid", []string{"tcp", "udp", "ts"}, "-ipid sends ICMP echoes with headers of its own"},
+	{"gaps", []string{"tcp"}, "-gaps follows the order of ICMP and -udp replies"},
+	{"compare", []string{"all", "dual", "gateway", "sweep", "loop", "pcap", "avg-only"}, "-compare pings its two destinations at once"},
+	{"on-breach", []string{"all", "dual", "compare", "gateway", "sweep"}, "alerts watch a single destination"},
+	{"webhook", []string{"all", "dual", "compare", "gateway", "sweep"}, "alerts watch a single destination"},
+	{"dry-run", []string{"loop", "all", "dual", "compare", "gateway", "sweep"}, "-dry-run checks the setup of a single session"},
+	{"expect-hops", []string{"tcp", "stream-stats"}, "-expect-hops needs the TTL of every reply"},
+	{"hops", []string{"tcp", "stream-stats"}, "-hops needs the TTL of every reply"},
+	{"local-port", []string{"tcp", "udp", "ipid", "randid", "all", "compare", "gateway", "sweep"}, "-local-port binds the one datagram ICMP socket of a run"},
+	{"gateway", []string{"all", "dual", "sweep", "loop", "pcap", "avg-only"}, "-gateway pings the destination and the gateway at once"},
+}
+
+// Returns the flags of fs that were set to something other than their
+// default, so that e.g. -redundancy 1 or -stream-stats=false, which change
+// nothing, don't count against the flags they would conflict with
+func flagsInEffect(fs *flag.FlagSet) map[string]bool {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		if f.Value.String() != f.DefValue {
+			set[f.Name] = true
+		}
+	})
+	return set
+}
+
+// Returns an error naming the first flag in set that is in effect together
+// with flags it conflicts with
+func checkFlagConflicts(set map[string]bool) error {
+	for _, conflict := range flagConflicts {
+		if !set[conflict.flag] {
+			continue
+		}
+		var given []string
+		for _, other := range conflict.others {
+			if set[other] {
+				given = append(given, "-"+other)
+			}
+		}
+		if len(given) > 0 {
+			return fmt.Errorf("-%s can't be combined with %s: %s", conflict.flag, strings.Join(given, ", "), conflict.reason)
+		}
+	}
+	return nil
+}
+
+// A duration flag that also takes a bare number of seconds, e.g. 0.2 as well
+// as 200ms, for compatibility with the float seconds the flags used to take
+type durationFlag time.Duration
+
+func (d *durationFlag) String() string {
+	return time.Duration(*d).String()
+}
+
+func (d *durationFlag) Set(value string) error {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		*d = durationFlag(seconds * float64(time.Second))
+		return nil
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return errors.New("not a duration or a number of seconds")
+	}
+	*d = durationFlag(parsed)
+	return nil
+}
+
+// Runs the mini-ping command line on os.Args and exits with its status
+func Main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] destination...\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintf(flag.CommandLine.Output(), "\nMost measurement options not given are taken from MINIPING_<NAME> environment variables, "+
+			"e.g. MINIPING_TTL_SWEEP, or MINIPING_COUNT for -c; see the README for the list.\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "\nExit codes:\n"+
+			"  %d  replies were received\n"+
+			"  %d  no replies were received\n"+
+			"  %d  an error prevented or aborted the run\n"+
+			"  %d  the -w deadline stopped the run before -c packets were sent\n"+
+			"  %d  the RTT exceeded -maxrtt\n"+
+			"  %d  the path length differed from -expect-hops\n"+
+			"  %d  a signal aborted the run without a summary\n",
+			exitSuccess, exitNoReplies, exitError, exitDeadline, exitSlow, exitHops, exitAborted)
+	}
+	count := flag.Int("c", math.MaxInt32, "number of packets to send until stopping")
+	ttl := flag.Int("t", 128, "time to live")
+	interval := durationFlag(time.Second)
+	flag.Var(&interval, "i", "time between consecutive pings, e.g. 200ms or 2m; a bare number is in seconds")
+	var flushEvery durationFlag
+	flag.Var(&flushEvery, "flush", "buffer the output and write it out this often, e.g. 100ms, instead of line by line")
+	var perPacketTimeout durationFlag
+	flag.Var(&perPacketTimeout, "W", "time to wait for the answer to each packet, e.g. 2s; a bare number is in seconds (default the -i interval)")
+	packetSize := flag.Int("s", 56, "number of bytes to send")
+	deadline := durationFlag(time.Duration(math.MaxInt32) * time.Second)
+	flag.Var(&deadline, "w", "time until stopping, e.g. 30s or 5m; a bare number is in seconds")
+	duration := flag.Duration("for", 0, "ping for this long, e.g. 30s or 5m, with no packet count")
+	jsonl := flag.Bool("jsonl", false, "stream a JSON line for every sent packet, reply and timeout")
+	randomID := flag.Bool("randid", false, "use a random ICMP echo identifier instead of the process ID")
+	randomSeq := flag.Bool("rand-seq", false, "start the ICMP sequence numbers on the wire at a random value instead of 0")
+	noIDMatch := flag.Bool("no-id-match", false, "match replies by sequence and payload token only, for middleboxes that rewrite the ICMP identifier")
+	tcpPort := flag.Int("tcp", 0, "measure RTT with TCP connects to this port instead of ICMP echoes")
+	tos := flag.Int("Q", -1, "set the 8-bit TOS/traffic class (DSCP and ECN) and check it on replies")
+	unreachableAfter := flag.Int("unreachable-after", 2, "abort after this many consecutive sends fail with no route to the destination (0 never aborts)")
+	jitter := flag.Float64("jitter", 0, "randomize each interval by up to this many percent either way")
+	histBins := flag.Int("hist", 0, "print a histogram of the RTTs with this many buckets")
+	wallclock := flag.Bool("wallclock", false, "measure RTTs with the system clock instead of the monotonic clock, to test behaviour under clock steps")
+	goodput := flag.Bool("goodput", false, "add a rough throughput estimate from the payload size, the reply rate and the RTT to the summary")
+	bestEffort := flag.Bool("best-effort", false, "log receive errors and keep going instead of aborting the run")
+	monitor := flag.Bool("monitor", false, "only print a timestamped line when the host goes up or down")
+	downAfter := flag.Int("down-after", 3, "consecutive lost packets before -monitor reports the host down")
+	upAfter := flag.Int("up-after", 1, "consecutive replies before -monitor reports the host up")
+	bufferSize := flag.Int("bufsize", 0, "size of the buffer replies are read into (default fits the packet size)")
+	hwtime := flag.Bool("hwtime", false, "time replies with the kernel's receive timestamps instead of when mini-ping reads them; Linux only")
+	logPath := flag.String("logfile", "", "append everything printed on stdout to this file as well")
+	logMaxSize := flag.String("logmax", "", "with -logfile, move the file to <path>.1 and start a new one before it grows past this size, e.g. 10M")
+	rcvbuf := flag.String("rcvbuf", "", "set the socket receive buffer (SO_RCVBUF) to this size, e.g. 4M, so high rates don't overflow it")
+	showTimes := flag.Bool("times", false, "print the send and receive timestamps of each reply")
+	payloadFile := flag.String("payload-file", "", "send the contents of this file as the echo data, sized by -s if given")
+	pattern := flag.String("pattern", "", "fill the echo data with a pattern checked on every reply; inc sends the bytes 0, 1, 2, ... 255, 0, ...")
+	udpPort := flag.Int("udp", 0, "measure RTT with UDP datagrams to this port, timing the ICMP port unreachable replies")
+	localPort := flag.Int("local-port", 0, "bind the datagram (unprivileged) ICMP socket to this port, which becomes the echo identifier")
+	via := flag.String("via", "", "send the packets through this IPv4 gateway with a loose source route, whatever the routing table says")
+	validateSource := flag.Bool("validate-reply-source", false, "drop echo replies that don't come from the destination, against spoofing")
+	replySourceList := flag.String("reply-sources", "", "comma-separated addresses besides the destination that replies may come from; implies -validate-reply-source")
+	fireAndForget := flag.Bool("fire-and-forget", false, "only send, without listening for replies (ICMP and -udp modes)")
+	redundancy := flag.Int("redundancy", 1, "send this many copies of each packet, for lossy links; the first reply to arrive is the one measured")
+	maxOutstanding := flag.Int("max-outstanding", 0, "pause sending while this many packets are unanswered (0 means no limit)")
+	excludeReordered := flag.Bool("exclude-reordered", false, "leave replies that arrive after those to later packets out of the rtt statistics")
+	excludePending := flag.Bool("exclude-pending", false, "leave packets still awaiting a reply at the -w deadline out of the loss")
+	resolveTimeout := durationFlag(10 * time.Second)
+	flag.Var(&resolveTimeout, "resolve-timeout", "give up resolving the destination after this long (0 waits for the system resolver)")
+	eventSocket := flag.String("event-socket", "", "stream the -jsonl events to the Unix socket at this path instead of stdout")
+	var maxTime durationFlag
+	flag.Var(&maxTime, "maxtime", "hard limit on the run time, e.g. 5m, that holds whatever else happens")
+	formatText := flag.String("format", "", "print each reply with this Go template, e.g. '{{.Seq}},{{.RTT}}', using Seq, Bytes, From, TTL and RTT")
+	showSrc := flag.Bool("show-src", false, "print the local address each echo request was sent from")
+	byteLimit := flag.String("bytes", "", "stop once this many bytes of ICMP messages were sent, e.g. 64K or 1M")
+	var report durationFlag
+	flag.Var(&report, "report", "print an interim summary this often, e.g. 1m, without stopping")
+	expectHops := flag.Int("expect-hops", -1, "exit with status 5 if the number of routers on the path, from -ttl-sweep or inferred from the reply TTL, isn't this")
+	showHops := flag.Bool("hops", false, "note the hops each reply took, estimated from its TTL, and summarize them; this counts the path back, which asymmetric routing can make differ from the path there")
+	expectTTL := flag.Int("expect-ttl", 0, "note replies arriving with a TTL other than this and summarize their inferred initial TTL")
+	var drain durationFlag
+	flag.Var(&drain, "drain", "keep listening this long after the run stops, e.g. 2s, to collect late replies")
+	var maxRTT durationFlag
+	flag.Var(&maxRTT, "maxrtt", "exit with status 4 if the RTT, as chosen by -maxrtt-stat, is above this, e.g. 50ms")
+	maxLoss := flag.Int("maxloss", -1, "with -on-breach or -webhook, alert when the loss is above this percentage")
+	onBreach := flag.String("on-breach", "", "run this shell command, with the stats as JSON on stdin, when -maxloss or -maxrtt is crossed")
+	webhook := flag.String("webhook", "", "POST the stats as JSON to this URL when -maxloss or -maxrtt is crossed")
+	maxRTTStat := flag.String("maxrtt-stat", rttStatAvg, "RTT aggregate checked against -maxrtt: avg, max or p95")
+	quiet := flag.Bool("q", false, "only print the summary, no line per packet")
+	avgOnly := flag.Bool("avg-only", false, "print nothing but the average rtt in ms, or NaN if nothing was answered, for LAT=$(mini-ping -avg-only host)")
+	onSignal := flag.String("on-signal", signalSummary, "what the first Ctrl-C does: summary stops, drains and prints the summary (a second one exits at once), immediate exits at once")
+	ipID := flag.Bool("ipid", false, "send IPv4 echoes with known IP IDs and report where ICMP errors quote them back rewritten, e.g. by NAT; use with -ttl-sweep")
+	gaps := flag.Bool("gaps", false, "print a line for every packet found missing, once it timed out and a later one was answered")
+	quietErrors := flag.Bool("quiet-errors", false, "print the replies but no lines for timeouts and messages that fail to parse")
+	timestamp := flag.Bool("ts", false, "send ICMP Timestamp requests (IPv4 only) and report the destination's clock offset")
+	verbose := flag.Bool("v", false, "print diagnostics, such as a hex dump of messages that fail to parse")
+	var reresolve durationFlag
+	flag.Var(&reresolve, "reresolve", "resolve the destination again this often, e.g. 5m, and follow address changes")
+	ttlSweep := flag.String("ttl-sweep", "", "send successive packets with the TTLs of this range, e.g. 1-10, and report the hop answering each")
+	numeric := flag.Bool("n", false, "under -ttl-sweep, print hop addresses without looking up their names")
+	probesPerHop := flag.Int("probes-per-hop", 1, "under -ttl-sweep, send this many packets with each TTL before moving on to the next")
+	streamStats := flag.Bool("stream-stats", false, "keep only running RTT aggregates and the latest packets instead of a record of every packet, for very long runs")
+	showLost := flag.Bool("lost", false, "list the sequence numbers that were never answered in the summary")
+	dual := flag.Bool("dual", false, "ping the IPv4 and the IPv6 address of the destination at the same time and compare them")
+	dryRun := flag.Bool("dry-run", false, "resolve the destination, open the socket and set its options, but send nothing; exits 0 if all of it worked")
+	compare := flag.Bool("compare", false, "ping two destinations at the same time and print their stats side by side, with a winner")
+	gateway := flag.Bool("gateway", false, "ping the default gateway alongside the destination and compare them, to tell local from upstream latency; Linux only")
+	all := flag.Bool("all", false, "ping every address the destination resolves to and rank them")
+	sweep := flag.String("sweep", "", "ping every address of this CIDR range, e.g. 192.168.1.0/24, and report which ones answer")
+	sweepWorkers := flag.Int("sweep-workers", 64, "how many addresses -sweep pings at the same time")
+	pcapPath := flag.String("pcap", "", "write the ICMP packets sent and received to this pcap file")
+	loop := flag.Bool("loop", false, "run sessions of -c packets or -w seconds back to back, with a summary after each")
+	summaryOnChange := flag.Bool("summary-on-change", false, "in -loop mode, only print a summary when loss or RTT changed since the previous session")
+	changeLoss := flag.Int("change-loss", 10, "loss change in percentage points that -summary-on-change reports")
+	changeRTT := flag.Float64("change-rtt", 20, "average RTT change in percent that -summary-on-change reports")
+	flag.Parse()
+	fromEnv, err := applyEnvDefaults(flag.CommandLine, os.LookupEnv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitError)
+	}
+	ipAddr := flag.Arg(0)
+	if interval <= 0 {
+		fmt.Fprintln(os.Stderr, "-i takes a positive interval")
+		os.Exit(exitError)
+	}
+	inEffect := dropConflictingEnvDefaults(flag.CommandLine, flagsInEffect(flag.CommandLine), fromEnv)
+	if err := checkFlagConflicts(inEffect); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitError)
+	}
+	// given on the command line or in the environment, less the environment
+	// defaults the command line overrode
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = !fromEnv[f.Name] || inEffect[f.Name]
+	})
+	if *duration != 0 {
+		if *duration < 0 {
+			fmt.Fprintln(os.Stderr, "-for takes a positive duration")
+			os.Exit(exitError)
+		}
+		deadline = durationFlag(*duration)
+	}
+	if *downAfter < 1 || *upAfter < 1 {
+		fmt.Fprintln(os.Stderr, "-down-after and -up-after must be at least 1")
+		os.Exit(exitError)
+	}
+	if *jitter < 0 || *jitter > 100 {
+		fmt.Fprintln(os.Stderr, "-jitter must be between 0 and 100 percent")
+		os.Exit(exitError)
+	}
+	var format *template.Template
+	if *formatText != "" {
+		var err error
+		if format, err = parseFormat(*formatText); err != nil {
+			fmt.Fprintln(os.Stderr, "invalid -format:", err)
+			os.Exit(exitError)
+		}
+	}
+	var socketReceiveBuffer int64
+	if *rcvbuf != "" {
+		var err error
+		if socketReceiveBuffer, err = parseByteSize(*rcvbuf); err != nil || socketReceiveBuffer > math.MaxInt32 {
+			fmt.Fprintln(os.Stderr, "-rcvbuf takes a size up to 2G, e.g. 4M")
+			os.Exit(exitError)
+		}
+	}
+	var maxBytes int64
+	if *byteLimit != "" {
+		var err error
+		if maxBytes, err = parseByteSize(*byteLimit); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitError)
+		}
+	}
+	sweepFrom, sweepTo := 0, 0
+	if *ttlSweep != "" {
+		bounds := strings.SplitN(*ttlSweep, "-", 2)
+		var fromErr, toErr error
+		sweepFrom, fromErr = strconv.Atoi(bounds[0])
+		if len(bounds) == 2 {
+			sweepTo, toErr = strconv.Atoi(bounds[1])
+		}
+		if len(bounds) != 2 || fromErr != nil || toErr != nil || sweepFrom < 1 || sweepTo > 255 || sweepFrom > sweepTo {
+			fmt.Fprintln(os.Stderr, "-ttl-sweep takes a range of TTLs between 1 and 255, e.g. 1-10")
+			os.Exit(exitError)
+		}
+	}
+	if *streamStats && *maxRTTStat == rttStatP95 {
+		fmt.Fprintln(os.Stderr, "-stream-stats doesn't keep the packets that -maxrtt-stat p95 needs")
+		os.Exit(exitError)
+	}
+	if *onSignal != signalSummary && *onSignal != signalImmediate {
+		fmt.Fprintln(os.Stderr, "-on-signal must be summary or immediate")
+		os.Exit(exitError)
+	}
+	if *redundancy < 1 {
+		fmt.Fprintln(os.Stderr, "-redundancy must be at least 1")
+		os.Exit(exitError)
+	}
+	if *probesPerHop < 1 {
+		fmt.Fprintln(os.Stderr, "-probes-per-hop must be at least 1")
+		os.Exit(exitError)
+	}
+	if *probesPerHop != 1 && *ttlSweep == "" {
+		fmt.Fprintln(os.Stderr, "-probes-per-hop only makes sense with -ttl-sweep")
+		os.Exit(exitError)
+	}
+	var viaGateway net.IP
+	if *via != "" {
+		if viaGateway = net.ParseIP(*via).To4(); viaGateway == nil {
+			fmt.Fprintf(os.Stderr, "-via: %q is not an IPv4 address\n", *via)
+			os.Exit(exitError)
+		}
+	}
+	var replySources []net.IP
+	if *replySourceList != "" {
+		var err error
+		if replySources, err = parseReplySources(*replySourceList); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitError)
+		}
+	}
+	if *localPort < 0 || *localPort > 65535 {
+		fmt.Fprintln(os.Stderr, "-local-port must be between 1 and 65535")
+		os.Exit(exitError)
+	}
+	if *expectHops < -1 || *expectHops > 254 {
+		fmt.Fprintln(os.Stderr, "-expect-hops must be between 0 and 254")
+		os.Exit(exitError)
+	}
+	if *expectTTL < 0 || *expectTTL > 255 {
+		fmt.Fprintln(os.Stderr, "-expect-ttl must be between 1 and 255")
+		os.Exit(exitError)
+	}
+	if *maxRTTStat != rttStatAvg && *maxRTTStat != rttStatMax && *maxRTTStat != rttStatP95 {
+		fmt.Fprintln(os.Stderr, "-maxrtt-stat must be avg, max or p95")
+		os.Exit(exitError)
+	}
+	if *avgOnly && flag.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, "-avg-only prints the average of one destination and can't be combined with several destinations")
+		os.Exit(exitError)
+	}
+	if *pattern != "" && *pattern != patternInc {
+		fmt.Fprintln(os.Stderr, "-pattern must be inc")
+		os.Exit(exitError)
+	}
+	if *maxOutstanding < 0 {
+		fmt.Fprintln(os.Stderr, "-max-outstanding must not be negative")
+		os.Exit(exitError)
+	}
+	if *dryRun && flag.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, "-dry-run checks a single destination")
+		os.Exit(exitError)
+	}
+	if *compare && flag.NArg() != 2 {
+		fmt.Fprintln(os.Stderr, "-compare takes two destinations")
+		os.Exit(exitError)
+	}
+	if flag.NArg() > 1 && (*all || *loop || *pcapPath != "") {
+		fmt.Fprintln(os.Stderr, "several destinations cannot be combined with -all, -loop or -pcap")
+		os.Exit(exitError)
+	}
+	if *gateway && flag.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, "-gateway takes a single destination")
+		os.Exit(exitError)
+	}
+	if *dual && flag.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, "-dual takes a single destination")
+		os.Exit(exitError)
+	}
+	var sweepNetwork *net.IPNet
+	if *sweep != "" {
+		if flag.NArg() > 0 {
+			fmt.Fprintln(os.Stderr, "-sweep takes the place of the destination")
+			os.Exit(exitError)
+		}
+		var err error
+		if _, sweepNetwork, err = net.ParseCIDR(*sweep); err != nil {
+			fmt.Fprintln(os.Stderr, "-sweep takes a CIDR range, e.g. 192.168.1.0/24:", err)
+			os.Exit(exitError)
+		}
+		if *sweepWorkers < 1 {
+			fmt.Fprintln(os.Stderr, "-sweep-workers must be at least 1")
+			os.Exit(exitError)
+		}
+		if !given["c"] {
+			// a sweep asks each address once
+			*count = 1
+		}
+		// the first address of the range stands in for the destination in the setup below
+		ipAddr = firstHost(sweepNetwork).String()
+	}
+	if *tos > 255 || *tos < -1 {
+		fmt.Fprintln(os.Stderr, "TOS must be between 0 and 255")
+		os.Exit(exitError)
+	}
+	var events net.Conn
+	if *eventSocket != "" {
+		var err error
+		if events, err = net.Dial("unix", *eventSocket); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot connect to the event socket, is the listener running? %v\n", err)
+			os.Exit(exitError)
+		}
+	}
+	var alerter *breachAlerter
+	if *onBreach != "" || *webhook != "" {
+		if *maxLoss < 0 && maxRTT <= 0 {
+			fmt.Fprintln(os.Stderr, "-on-breach and -webhook need a threshold, -maxloss or -maxrtt")
+			os.Exit(exitError)
+		}
+		if *maxLoss > 100 {
+			fmt.Fprintln(os.Stderr, "-maxloss must be between 0 and 100 percent")
+			os.Exit(exitError)
+		}
+		if flag.NArg() > 1 {
+			fmt.Fprintln(os.Stderr, "-on-breach and -webhook watch a single destination")
+			os.Exit(exitError)
+		}
+		alerter = newBreachAlerter(*onBreach, *webhook, *maxLoss)
+	} else if *maxLoss >= 0 {
+		fmt.Fprintln(os.Stderr, "-maxloss only makes sense with -on-breach or -webhook")
+		os.Exit(exitError)
+	}
+	var logFile *rotatingWriter
+	if *logPath != "" {
+		var logMax int64
+		if *logMaxSize != "" {
+			var err error
+			if logMax, err = parseByteSize(*logMaxSize); err != nil {
+				fmt.Fprintln(os.Stderr, "-logmax takes a size, e.g. 10M:", err)
+				os.Exit(exitError)
+			}
+		}
+		var err error
+		if logFile, err = openRotatingWriter(*logPath, logMax); err != nil {
+			fmt.Fprintln(os.Stderr, "cannot open the log file:", err)
+			os.Exit(exitError)
+		}
+	} else if *logMaxSize != "" {
+		fmt.Fprintln(os.Stderr, "-logmax only makes sense with -logfile")
+		os.Exit(exitError)
+	}
+	// each -loop session gets a fresh pinger with the same settings
+	var buffered *flushingWriter
+	newPinger := func(target string) (*MiniPinger, error) {
+		mp, err := NewMiniPinger(target, Options{
+			Count:            *count,
+			TTL:              *ttl,
+			Interval:         time.Duration(interval),
+			PacketSize:       *packetSize,
+			PerPacketTimeout: time.Duration(perPacketTimeout),
+			Deadline:         time.Duration(deadline),
+			ResolveTimeout:   time.Duration(resolveTimeout),
+		})
+		if err != nil {
+			return nil, err
+		}
+		mp.jsonl = *jsonl
+		mp.tcpPort = *tcpPort
+		mp.udpPort = *udpPort
+		mp.noIDMatch = *noIDMatch
+		mp.localPort = *localPort
+		mp.validateSource = *validateSource || len(replySources) > 0
+		mp.replySources = replySources
+		mp.via = viaGateway
+		mp.showTimes = *showTimes
+		mp.bufferSize = *bufferSize
+		mp.socketReceiveBuffer = int(socketReceiveBuffer)
+		if *hwtime {
+			mp.kernelTimestamps = true
+			mp.stampSources = make(map[string]int)
+		}
+		mp.monitor = *monitor
+		mp.downAfter = *downAfter
+		mp.upAfter = *upAfter
+		mp.bestEffort = *bestEffort
+		mp.histBins = *histBins
+		mp.goodput = *goodput
+		mp.streamStats = *streamStats
+		mp.quietErrors = *quietErrors
+		mp.showGaps = *gaps
+		mp.avgOnly = *avgOnly
+		mp.redundancy = *redundancy
+		if *wallclock {
+			mp.now = wallClock
+		}
+		mp.jitter = *jitter
+		mp.unreachableAfter = *unreachableAfter
+		mp.tos = *tos
+		mp.fireAndForget = *fireAndForget
+		mp.maxOutstanding = *maxOutstanding
+		mp.excludePending = *excludePending
+		mp.excludeReordered = *excludeReordered
+		mp.duration = *duration
+		mp.showLost = *showLost
+		mp.sweepFrom = sweepFrom
+		mp.sweepTo = sweepTo
+		mp.probesPerHop = *probesPerHop
+		mp.numeric = *numeric
+		mp.reresolve = time.Duration(reresolve)
+		mp.verbose = *verbose
+		mp.timestamp = *timestamp
+		mp.ipIDs = *ipID
+		// a -sweep only reports which addresses are up
+		mp.quiet = *quiet || sweepNetwork != nil
+		mp.format = format
+		mp.maxTime = time.Duration(maxTime)
+		if events != nil {
+			// the events go to the socket, stdout keeps the summary
+			mp.jsonl = true
+			mp.eventSocket = true
+			mp.events = json.NewEncoder(events)
+		}
+		mp.maxRTT = time.Duration(maxRTT)
+		mp.maxRTTStat = *maxRTTStat
+		mp.drain = time.Duration(drain)
+		mp.expectTTL = *expectTTL
+		mp.showHops = *showHops
+		mp.expectHops = *expectHops
+		mp.report = time.Duration(report)
+		mp.maxBytes = maxBytes
+		mp.showSrc = *showSrc
+		if logFile != nil {
+			mp.logTo(logFile)
+		}
+		mp.alerter = alerter
+		mp.dryRun = *dryRun
+		if flushEvery > 0 {
+			// one buffer for the pingers of all destinations and sessions
+			if buffered == nil {
+				buffered = newFlushingWriter(mp.console)
+			}
+			mp.bufferOutput(buffered, time.Duration(flushEvery))
+		}
+		if mp.ipIDs && !mp.isIPv4 {
+			return nil, errors.New("-ipid needs IPv4, IPv6 headers have no ID field")
+		}
+		if mp.timestamp && !mp.isIPv4 {
+			return nil, errors.New("-ts sends ICMP Timestamp requests, which only exist for IPv4")
+		}
+		if mp.via != nil && !mp.isIPv4 {
+			return nil, errors.New("-via needs IPv4, IPv6 has no source routing left in use")
+		}
+		if *payloadFile != "" {
+			size := -1
+			if given["s"] {
+				size = *packetSize
+			}
+			if err := mp.loadPayloadFile(*payloadFile, size); err != nil {
+				return nil, err
+			}
+		}
+		if *pattern == patternInc {
+			mp.useIncrementingPattern()
+		}
+		if *randomID {
+			if err := mp.randomizeID(); err != nil {
+				return nil, err
+			}
+		}
+		if *randomSeq {
+			if err := mp.randomizeSeqStart(); err != nil {
+				return nil, err
+			}
+		}
+		return mp, nil
+	}
+	mp, err := newPinger(ipAddr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitError)
+	}
+	var pcap *pcapWriter
+	if *pcapPath != "" {
+		var err error
+		if pcap, err = newPcapWriter(*pcapPath, !mp.isIPv4); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitError)
+		}
+		mp.pcap = pcap
+	}
+	// closes the files shared by all sessions and exits
+	exit := func(code int) {
+		if pcap != nil {
+			pcap.Close()
+		}
+		if events != nil {
+			events.Close()
+		}
+		if alerter != nil {
+			alerter.wait()
+		}
+		if logFile != nil {
+			logFile.Close()
+		}
+		os.Exit(code)
+	}
+	if *loop && !mp.hasCount() && !mp.hasDeadline() {
+		fmt.Fprintln(os.Stderr, "-loop needs -c or -w to end each session")
+		os.Exit(exitError)
+	}
+	if pid := os.Getpid(); !*randomID && mp.tcpPort == 0 && mp.udpPort == 0 && *localPort == 0 && pid > 0xffff {
+		fmt.Fprintf(os.Stderr, "warning: process ID %d does not fit the 16-bit ICMP identifier and is truncated to %d, "+
+			"which makes collisions with other pingers more likely; consider -randid\n", pid, mp.id)
+	}
+	interrupted := make(chan bool)
+	ctrlc := make(chan os.Signal, 1)
+	signal.Notify(ctrlc, os.Interrupt, syscall.SIGTERM)
+	go handleSignals(ctrlc, interrupted, *onSignal == signalImmediate, func() {
+		exit(exitAborted)
+	})
+	if sweepNetwork != nil {
+		exit(pingRange(sweepNetwork, *sweepWorkers, newPinger, interrupted))
+	}
+	if *gateway {
+		exit(pingWithGateway(ipAddr, time.Duration(resolveTimeout), newPinger, interrupted))
+	}
+	if *dual {
+		exit(pingDual(ipAddr, time.Duration(resolveTimeout), newPinger, interrupted))
+	}
+	if *all {
+		exit(pingAll(ipAddr, time.Duration(resolveTimeout), newPinger, interrupted))
+	}
+	if *compare {
+		exit(pingCompare(flag.Args(), newPinger, interrupted))
+	}
+	if flag.NArg() > 1 {
+		exit(pingHosts(flag.Args(), newPinger, interrupted))
+	}
+	var previous *Stats
+	round := 1
+	if *loop {
+		mp.setRound(round)
+	}
+	for {
+		mp.interrupted = interrupted
+		go mp.stopWhenClosed(interrupted)
+		mp.Run()
+		stats := mp.stats()
+		if alerter != nil {
+			alerter.check(mp, stats)
+		}
+		if !*summaryOnChange || previous == nil || summaryChanged(*previous, stats, *changeLoss, *changeRTT) {
+			mp.printStats()
+		}
+		previous = &stats
+		if !*loop || mp.runErr != nil || stats.StopReason == stopInterrupted {
+			exit(mp.exitCode(stats))
+		}
+		// the next session keeps the address and the identity of this one
+		next, err := newPinger(mp.destination().String())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit(exitError)
+		}
+		next.continueFrom(mp)
+		mp = next
+		mp.pcap = pcap
+		round++
+		mp.setRound(round)
+	}
+}
@@ -0,0 +1,284 @@
+package miniping
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDurationFlag(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+		err   bool
+	}{
+		{"200ms", 200 * time.Millisecond, false},
+		{"1.5", 1500 * time.Millisecond, false},
+		{"2m", 2 * time.Minute, false},
+		{"1", time.Second, false},
+		{"1m30s", 90 * time.Second, false},
+		{"soon", 0, true},
+	}
+	for _, tt := range tests {
+		var d durationFlag
+		err := d.Set(tt.value)
+		if (err != nil) != tt.err {
+			t.Errorf("%q: error %v, want one %v", tt.value, err, tt.err)
+			continue
+		}
+		if time.Duration(d) != tt.want {
+			t.Errorf("%q: %v, want %v", tt.value, time.Duration(d), tt.want)
+		}
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int64
+	}{
+		{"1500", 1500},
+		{"64K", 64 << 10},
+		{"1m", 1 << 20},
+		{"2G", 2 << 30},
+		{"0", 0},
+		{"M", 0},
+		{"1.5M", 0},
+	}
+	for _, tt := range tests {
+		got, err := parseByteSize(tt.value)
+		if got != tt.want || (err != nil) != (tt.want == 0) {
+			t.Errorf("%s: %d, %v, want %d", tt.value, got, err, tt.want)
+		}
+	}
+}
+
+// The first interrupt drains the run and the second aborts it, or the first
+// does right away with -on-signal immediate
+func TestHandleSignals(t *testing.T) {
+	tests := []struct {
+		name      string
+		immediate bool
+		// signals until the run is aborted
+		signals int
+	}{
+		{"drain", false, 2},
+		{"immediate", true, 1},
+	}
+	for _, tt := range tests {
+		signals := make(chan os.Signal, 1)
+		interrupted := make(chan bool)
+		aborted := make(chan struct{})
+		go handleSignals(signals, interrupted, tt.immediate, func() {
+			close(aborted)
+		})
+		for sent := 1; sent <= tt.signals; sent++ {
+			signals <- os.Interrupt
+			if sent < tt.signals {
+				select {
+				case <-interrupted:
+				case <-time.After(time.Second):
+					t.Fatalf("%s: signal %d didn't interrupt the run", tt.name, sent)
+				}
+				select {
+				case <-aborted:
+					t.Fatalf("%s: signal %d aborted the run instead of draining it", tt.name, sent)
+				default:
+				}
+				continue
+			}
+			// the run is still draining, if it ever ends
+			select {
+			case <-aborted:
+			case <-time.After(time.Second):
+				t.Fatalf("%s: signal %d didn't abort the run", tt.name, sent)
+			}
+		}
+	}
+}
+
+func TestCheckFlagConflicts(t *testing.T) {
+	tests := []struct {
+		set  []string
+		want string
+	}{
+		{nil, ""},
+		{[]string{"c", "i", "q"}, ""},
+		{[]string{"tcp", "udp"}, "-tcp can't be combined with -udp: a run probes with one protocol"},
+		{[]string{"for", "c", "w"}, "-for can't be combined with -c, -w: -for replaces -c and -w"},
+		{[]string{"q", "v"}, "-q can't be combined with -v"},
+		{[]string{"avg-only", "jsonl"}, "-avg-only can't be combined with -jsonl"},
+		{[]string{"sweep", "loop"}, "-sweep can't be combined with -loop"},
+	}
+	for _, tt := range tests {
+		set := make(map[string]bool)
+		for _, name := range tt.set {
+			set[name] = true
+		}
+		err := checkFlagConflicts(set)
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("%v: %v, want no conflict", tt.set, err)
+			}
+			continue
+		}
+		if err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+			t.Errorf("%v: %v, want %q", tt.set, err, tt.want)
+		}
+	}
+}
+
+// A flag set to its default changes nothing, so it can't conflict
+func TestFlagsInEffect(t *testing.T) {
+	fs := flag.NewFlagSet("mini-ping", flag.ContinueOnError)
+	fs.Bool("tcp", false, "")
+	fs.Bool("udp", false, "")
+	fs.Int("redundancy", 1, "")
+	if err := fs.Parse([]string{"-tcp", "-udp=false", "-redundancy", "1"}); err != nil {
+		t.Fatal(err)
+	}
+	set := flagsInEffect(fs)
+	if !set["tcp"] || set["udp"] || set["redundancy"] {
+		t.Errorf("flags in effect %v, want only tcp", set)
+	}
+	if err := checkFlagConflicts(set); err != nil {
+		t.Errorf("-tcp -udp=false: %v", err)
+	}
+}
+
+func TestApplyEnvDefaults(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		env      map[string]string
+		count    int
+		interval time.Duration
+		fromEnv  map[string]bool
+		err      string
+	}{
+		{"no variables", nil, nil, 0, time.Second, map[string]bool{}, ""},
+		{"count", nil, map[string]string{"MINIPING_COUNT": "5"}, 5, time.Second, map[string]bool{"c": true}, ""},
+		{"command line wins", []string{"-c", "3"}, map[string]string{"MINIPING_COUNT": "5"}, 3, time.Second, map[string]bool{}, ""},
+		{"seconds", nil, map[string]string{"MINIPING_INTERVAL": "0.2"}, 0, 200 * time.Millisecond, map[string]bool{"i": true}, ""},
+		{"flags without a variable", nil, map[string]string{"MINIPING_SWEEP": "192.0.2.0/24"}, 0, time.Second, map[string]bool{}, ""},
+		{"invalid value", nil, map[string]string{"MINIPING_COUNT": "many"}, 0, time.Second, nil, `invalid value "many" for MINIPING_COUNT`},
+	}
+	for _, tt := range tests {
+		fs := flag.NewFlagSet("mini-ping", flag.ContinueOnError)
+		count := fs.Int("c", 0, "")
+		interval := durationFlag(time.Second)
+		fs.Var(&interval, "i", "")
+		fs.String("sweep", "", "")
+		if err := fs.Parse(tt.args); err != nil {
+			t.Fatal(err)
+		}
+		fromEnv, err := applyEnvDefaults(fs, func(name string) (string, bool) {
+			value, ok := tt.env[name]
+			return value, ok
+		})
+		if tt.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+				t.Errorf("%s: %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if *count != tt.count || time.Duration(interval) != tt.interval || !reflect.DeepEqual(fromEnv, tt.fromEnv) {
+			t.Errorf("%s: -c %d -i %v from the environment %v, want -c %d -i %v from %v", tt.name,
+				*count, time.Duration(interval), fromEnv, tt.count, tt.interval, tt.fromEnv)
+		}
+	}
+}
+
+// A flag from the environment gives way to a conflicting one on the command line
+func TestDropConflictingEnvDefaults(t *testing.T) {
+	fs := flag.NewFlagSet("mini-ping", flag.ContinueOnError)
+	tcp := fs.Bool("tcp", false, "")
+	udp := fs.Bool("udp", false, "")
+	if err := fs.Parse([]string{"-tcp"}); err != nil {
+		t.Fatal(err)
+	}
+	fromEnv, err := applyEnvDefaults(fs, func(name string) (string, bool) {
+		return "true", name == "MINIPING_UDP"
+	})
+	if err != nil || !*udp {
+		t.Fatalf("MINIPING_UDP=true: -udp %v (%v)", *udp, err)
+	}
+	set := dropConflictingEnvDefaults(fs, flagsInEffect(fs), fromEnv)
+	if !*tcp || *udp || set["udp"] {
+		t.Errorf("-tcp %v -udp %v in effect %v, want only the -tcp given", *tcp, *udp, set)
+	}
+	if err := checkFlagConflicts(set); err != nil {
+		t.Error(err)
+	}
+}
+
+// A path of another length than -expect-hops, or of no known length, fails
+// the run with its own exit code
+func TestExpectHopsExitCode(t *testing.T) {
+	tests := []struct {
+		name       string
+		expectHops int
+		packets    []PacketRecord
+		want       int
+		verdict    string
+	}{
+		{"not checked", -1, repliesWithTTLs(57), exitSuccess, ""},
+		{"as expected", 7, repliesWithTTLs(57, 57), exitSuccess, "path: 7 hops inferred from the reply ttl, as expected\n"},
+		{"longer path", 5, repliesWithTTLs(57, 0), exitHops, "path: 7 hops inferred from the reply ttl, expected 5\n"},
+		// replies that came without a TTL
+		{"unknown path", 7, []PacketRecord{{Seq: 0, Status: statusReplied}}, exitHops,
+			"path: unknown, no reply tells the hop count, expected 7\n"},
+	}
+	for _, tt := range tests {
+		mp := testPinger("192.0.2.1")
+		mp.expectHops = tt.expectHops
+		stats := Stats{Sent: len(tt.packets), Received: 1, Packets: tt.packets}
+		if got := mp.exitCode(stats); got != tt.want {
+			t.Errorf("%s: exit code %d, want %d", tt.name, got, tt.want)
+		}
+		if tt.expectHops < 0 {
+			continue
+		}
+		var verdict bytes.Buffer
+		mp.printPathVerdict(&verdict, stats)
+		if verdict.String() != tt.verdict {
+			t.Errorf("%s: verdict %q, want %q", tt.name, verdict.String(), tt.verdict)
+		}
+	}
+}
+
+// -reply-sources takes a comma-separated list of addresses
+func TestParseReplySources(t *testing.T) {
+	tests := []struct {
+		list string
+		want []string
+		err  bool
+	}{
+		{"192.0.2.9", []string{"192.0.2.9"}, false},
+		{"192.0.2.9, 2001:db8::9", []string{"192.0.2.9", "2001:db8::9"}, false},
+		{"192.0.2.9,router", nil, true},
+		{"", nil, true},
+	}
+	for _, tt := range tests {
+		addresses, err := parseReplySources(tt.list)
+		if (err != nil) != tt.err {
+			t.Errorf("%q: error %v, want one %v", tt.list, err, tt.err)
+			continue
+		}
+		var got []string
+		for _, address := range addresses {
+			got = append(got, address.String())
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: addresses %v, want %v", tt.list, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,1067 @@
+// Package miniping pings hosts with ICMP echoes, or TCP connects or UDP
+// datagrams, and reports round trip times and loss. NewMiniPinger and Run are
+// for programs embedding it; Main is the mini-ping command line.
+package miniping
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"text/template"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+type MiniPinger struct {
+	// OnReply, if set, is called with every reply to one of our packets, and
+	// OnTimeout with the sequence number of every packet that timed out, for
+	// embedders that want the events as they happen. The calls are never
+	// concurrent and hold none of the pinger's locks, but they are made from
+	// the goroutine matching replies, so a callback that blocks holds up the
+	// replies after it. Set them before Run.
+	OnReply   func(PacketResult)
+	OnTimeout func(seq int)
+	callbacks sync.Mutex
+	// the destination, which -reresolve may switch under mp.mu, so it is read
+	// through destination(); its address family never changes
+	ipAddress  *net.IPAddr
+	isIPv4     bool
+	count      int
+	ttl        int
+	interval   time.Duration
+	packetSize int
+	// how long to wait for the answer to each packet (-W)
+	perPacketTimeout time.Duration
+	// how long the whole run may take (-w)
+	totalDeadline   time.Duration
+	packetsReceived int
+	packetsSent     int
+	timeSent        map[int]time.Time
+	timers          map[int]*time.Timer
+	packets         []PacketRecord
+	startTime       time.Time
+	finished        chan bool
+	// closed on the first interrupt, which also cuts a -drain short
+	interrupted chan bool
+	replies     chan *reply
+	timeouts    chan int
+	mu          sync.Mutex
+	jsonl       bool
+	events      *json.Encoder
+	// serializes the event lines apart from mu, so that a slow -event-socket
+	// reader only holds up the goroutine writing to it
+	eventsMu   sync.Mutex
+	id         int
+	token      []byte
+	payload    []byte
+	stopOnce   sync.Once
+	stopReason string
+	tcpPort    int
+	udpPort    int
+	// the local port -udp probes leave from, which port unreachables quote back
+	udpSourcePort int
+	lastTTL       int
+	ttlChanges    int
+	tos           int
+	tosRemarked   int
+	// the clock send and receive times are taken from: time.Now, whose
+	// readings carry the monotonic clock that RTTs are measured with, or
+	// wallClock under -wallclock
+	now func() time.Time
+	// opens the ICMP socket, listen unless replaced
+	open func() (icmpConn, string, error)
+	// opens an ICMP socket for listen, listenICMP unless replaced
+	listenPacket       func(network, address string) (icmpConn, error)
+	showTimes          bool
+	bufferSize         int
+	monitor            bool
+	downAfter          int
+	upAfter            int
+	hostState          string
+	consecutiveLosses  int
+	consecutiveReplies int
+	bestEffort         bool
+	runErr             error
+	histBins           int
+	noIDMatch          bool
+	// -local-port: the port to bind the datagram ICMP socket to, which
+	// becomes the identifier; 0 lets the kernel pick
+	localPort int
+	// -validate-reply-source: drop echo replies from other addresses than the
+	// destination and the -reply-sources, counting them in rejectedSources
+	validateSource  bool
+	replySources    []net.IP
+	rejectedSources int
+	// ICMP errors from other addresses than those, accepted unvalidated
+	routerErrors int
+	// -via: the gateway the packets are source routed through, if any
+	via net.IP
+	// -hops: note the hop count each reply TTL implies
+	showHops         bool
+	jitter           float64
+	unreachableAfter int
+	unreachableSends int
+	fireAndForget    bool
+	pcap             *pcapWriter
+	shortReplies     int
+	pattern          string
+	corruptReplies   int
+	maxOutstanding   int
+	outstanding      int
+	released         chan struct{}
+	// signalled whenever one of the counts checkFinish watches changes
+	progress       chan struct{}
+	excludePending bool
+	duration       time.Duration
+	showLost       bool
+	sweepFrom      int
+	sweepTo        int
+	probesPerHop   int
+	socketTTL      int
+	hostname       string
+	reresolve      time.Duration
+	verbose        bool
+	timestamp      bool
+	quiet          bool
+	resolve        func(host string) (*net.IPAddr, error)
+	lookupName     func(address string) string
+	numeric        bool
+	hopNames       map[string]string
+	// closed once the background lookup of an address's name finishes
+	hopLookups map[string]chan struct{}
+	seqStart   int
+	// where output goes before any -loop prefix: stdout, or a buffer in front of it with -flush
+	console       io.Writer
+	buffered      *flushingWriter
+	flushEvery    time.Duration
+	latestReplied int
+	reordered     int
+	// -gaps: report a packet as missing once it timed out and a later one was answered
+	showGaps         bool
+	excludeReordered bool
+	goodput          bool
+	// under -stream-stats, the records before packetBase are folded into folded
+	streamStats bool
+	quietErrors bool
+	// -ipid: echoes go out through headerConn with IP IDs of our choosing, which
+	// are checked against the headers quoted back in ICMP errors
+	ipIDs          bool
+	headerConn     *ipv4.RawConn
+	ipIDsChecked   int
+	ipIDsRewritten int
+	// -on-breach and -webhook, shared by the sessions of a -loop
+	alerter *breachAlerter
+	// -dry-run: set everything up but send nothing
+	dryRun bool
+	// -avg-only: the summary is just the average RTT
+	avgOnly             bool
+	socketReceiveBuffer int
+	// -hwtime: take receive times from the socket's timestamps, counted per source
+	kernelTimestamps bool
+	stampSources     map[string]int
+	redundancy       int
+	duplicates       int
+	packetBase       int
+	folded           foldedPackets
+	maxRTT           time.Duration
+	maxRTTStat       string
+	drain            time.Duration
+	listenDone       chan bool
+	drainedReplies   int
+	expectTTL        int
+	// -expect-hops, -1 when the path length isn't checked
+	expectHops    int
+	initialTTLs   map[int]int
+	customPayload bool
+	report        time.Duration
+	maxBytes      int64
+	bytesSent     int64
+	bytesReceived int64
+	showSrc       bool
+	datagram      bool
+	eventSocket   bool
+	format        *template.Template
+	maxTime       time.Duration
+	round         int
+	stdout        io.Writer
+	drifts        int
+	minDrift      time.Duration
+	maxDrift      time.Duration
+	totalDrift    time.Duration
+	// send slots nextSend skipped after falling behind
+	skippedSends int
+}
+
+// How long past -maxtime the run may take to wind down before it is abandoned,
+// and how long the summary then waits for the reader and matcher to stop
+const maxTimeGrace = time.Second
+
+// Reasons a run can stop for
+const (
+	stopCount       = "count"
+	stopDeadline    = "deadline"
+	stopInterrupted = "interrupted"
+	stopError       = "error"
+	stopBytes       = "bytes"
+	stopMaxTime     = "maxtime"
+)
+
+// Status values of a PacketRecord
+const (
+	statusPending  = "pending"
+	statusReplied  = "replied"
+	statusTimeout  = "timeout"
+	statusRefused  = "refused"
+	statusError    = "error"
+	statusExceeded = "exceeded"
+)
+
+// A reply as handed to OnReply
+type PacketResult struct {
+	Seq int
+	// the address the reply came from
+	From       string
+	Bytes      int
+	TTL        int
+	RTT        time.Duration
+	ReceivedAt time.Time
+}
+
+// Hands a reply to OnReply
+func (mp *MiniPinger) notifyReply(result PacketResult) {
+	if mp.OnReply == nil {
+		return
+	}
+	mp.callbacks.Lock()
+	defer mp.callbacks.Unlock()
+	mp.OnReply(result)
+}
+
+// Hands a timed out packet to OnTimeout
+func (mp *MiniPinger) notifyTimeout(seq int) {
+	if mp.OnTimeout == nil {
+		return
+	}
+	mp.callbacks.Lock()
+	defer mp.callbacks.Unlock()
+	mp.OnTimeout(seq)
+}
+
+// The replies that came from one address
+type ResponderStats struct {
+	Address string  `json:"address"`
+	Replies int     `json:"replies"`
+	AvgRTT  float64 `json:"avg_rtt_ms"`
+}
+
+// What happened to a single sent packet, indexed by its sequence number
+type PacketRecord struct {
+	Seq    int           `json:"seq"`
+	SentAt time.Time     `json:"sent_at"`
+	RTT    time.Duration `json:"rtt_ns"`
+	TTL    int           `json:"ttl"`
+	Status string        `json:"status"`
+	From   string        `json:"from,omitempty"`
+	Offset time.Duration `json:"offset_ns,omitempty"`
+	OneWay time.Duration `json:"one_way_ns,omitempty"`
+	// the -ts reply carried no standard timestamps, so Offset and OneWay are unknown
+	NoTimestamps bool `json:"no_timestamps,omitempty"`
+	// answered after a packet sent later than it
+	OutOfOrder bool `json:"out_of_order,omitempty"`
+}
+
+// Overall statistics of a run, with the per-packet timeline they were computed
+// from. The RTT aggregates are zero, never NaN or a sentinel, when no packet
+// was answered.
+type Stats struct {
+	Sent     int `json:"sent"`
+	Received int `json:"received"`
+	Loss     int `json:"loss_percent"`
+	// set when -exclude-pending left no packet to count the loss over, as
+	// when all were still in flight at the deadline; Loss is 0 then
+	LossUndefined bool              `json:"loss_undefined,omitempty"`
+	Elapsed       time.Duration     `json:"elapsed_ns"`
+	MinRTT        float64           `json:"min_rtt_ms"`
+	MaxRTT        float64           `json:"max_rtt_ms"`
+	AvgRTT        float64           `json:"avg_rtt_ms"`
+	StddevRTT     float64           `json:"stddev_rtt_ms"`
+	StopReason    string            `json:"stop_reason"`
+	TTLChanges    int               `json:"ttl_changes"`
+	TOSRemarked   int               `json:"tos_remarked"`
+	Histogram     []HistogramBucket `json:"histogram,omitempty"`
+	Errors        int               `json:"errors"`
+	ShortReplies  int               `json:"short_replies"`
+	Corrupted     int               `json:"corrupted"`
+	Reordered     int               `json:"reordered"`
+	// further replies to a packet already answered, as -redundancy asks for
+	Duplicates int `json:"duplicates"`
+	// -ipid: IP IDs found in the headers quoted by ICMP errors, and how many
+	// of them differ from the ID sent
+	IPIDsChecked   int `json:"ip_ids_checked"`
+	IPIDsRewritten int `json:"ip_ids_rewritten"`
+	// the replies by the address they came from, when any came from another
+	// address than the destination, as with anycast
+	Responders []ResponderStats `json:"responders,omitempty"`
+	// replies -validate-reply-source dropped for their source address
+	RejectedSources int `json:"rejected_sources"`
+	// ICMP errors from routers, not the destination, that -validate-reply-source
+	// accepted as they can't come from anywhere else
+	RouterErrors int `json:"router_errors"`
+	// rough estimates from the payload size, see estimateGoodput
+	PacketsPerSecond float64 `json:"packets_per_second"`
+	GoodputEstimate  float64 `json:"goodput_estimate_bps"`
+	RTTBoundEstimate float64 `json:"rtt_bound_estimate_bps"`
+	Drained          int     `json:"drained"`
+	// the -via gateway the packets were source routed through
+	Via           string  `json:"via,omitempty"`
+	BytesSent     int64   `json:"bytes_sent"`
+	BytesReceived int64   `json:"bytes_received"`
+	MinDrift      float64 `json:"min_send_drift_ms"`
+	MaxDrift      float64 `json:"max_send_drift_ms"`
+	AvgDrift      float64 `json:"avg_send_drift_ms"`
+	// send slots skipped to keep to the schedule after falling an interval behind
+	SkippedSends      int   `json:"skipped_sends"`
+	PendingAtDeadline int   `json:"pending_at_deadline"`
+	LostSeqs          []int `json:"lost_seqs"`
+	// the longest run of consecutive packets lost, to tell bursty loss from
+	// loss spread over the run
+	MaxLossStreak int            `json:"max_consecutive_loss"`
+	Packets       []PacketRecord `json:"packets"`
+}
+
+// Number of RTT samples between From and To milliseconds
+type HistogramBucket struct {
+	From  float64 `json:"from_ms"`
+	To    float64 `json:"to_ms"`
+	Count int     `json:"count"`
+}
+
+// Length of the random per-session token placed at the start of every payload
+const tokenLength = 8
+
+// Largest ICMP echo payload that fits in an IP packet: the 65535 byte limit minus
+// the 8 byte ICMP header and, for IPv4, the 20 byte IP header (the IPv6 payload
+// length doesn't include its header)
+const (
+	maxPayloadIPv4 = 65535 - 20 - 8
+	maxPayloadIPv6 = 65535 - 8
+)
+
+// Payload patterns for -pattern
+const (
+	patternInc = "inc"
+)
+
+// A parsed packet handed from the reader to the matcher
+type reply struct {
+	message    *icmp.Message
+	numBytes   int
+	ttl        int
+	tos        int
+	receivedAt time.Time
+	truncated  bool
+	src        net.Addr
+	dst        net.IP
+}
+
+// A per-packet event streamed as one JSON line in -jsonl mode
+type event struct {
+	Type         string    `json:"type"`
+	Time         time.Time `json:"time"`
+	Seq          int       `json:"seq"`
+	Bytes        int       `json:"bytes,omitempty"`
+	TTL          int       `json:"ttl,omitempty"`
+	RTT          float64   `json:"rtt_ms,omitempty"`
+	RouteChanged bool      `json:"route_changed,omitempty"`
+	// the -hops estimate, which is 0 for a destination on the local network
+	Hops *int `json:"hops,omitempty"`
+	// the packets lost in a row that took a -monitor host down
+	ConsecutiveLost int `json:"consecutive_lost,omitempty"`
+}
+
+// Kinds of failure NewMiniPinger and Run report, for callers to tell apart
+// with errors.Is
+var (
+	ErrResolveFailed    = errors.New("cannot resolve destination")
+	ErrPermissionDenied = errors.New("permission denied")
+	ErrNoRoute          = errors.New("no route to destination")
+	ErrTimeout          = errors.New("no reply before the run ended")
+	ErrInvalidArgument  = errors.New("invalid argument")
+)
+
+// An error of one of the kinds above, wrapping the error that caused it
+type PingError struct {
+	Kind error
+	Err  error
+}
+
+func (e *PingError) Error() string {
+	return e.Kind.Error() + ": " + e.Err.Error()
+}
+
+func (e *PingError) Unwrap() error {
+	return e.Err
+}
+
+// Makes errors.Is match the kind as well as the wrapped cause
+func (e *PingError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// Wraps err in the kind of failure it stands for, if it is one of them
+func classifyError(err error) error {
+	switch {
+	case errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES):
+		return &PingError{Kind: ErrPermissionDenied, Err: err}
+	case errors.Is(err, syscall.ENETUNREACH) || errors.Is(err, syscall.EHOSTUNREACH):
+		return &PingError{Kind: ErrNoRoute, Err: err}
+	}
+	return err
+}
+
+// Returns a context for resolving host names that gives up after timeout, or
+// never with a timeout of zero
+func resolveContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// Resolves host to one address, preferring IPv4 like net.ResolveIPAddr, but
+// giving up after timeout instead of the system resolver's own, long, one
+func resolveIPAddr(host string, timeout time.Duration) (*net.IPAddr, error) {
+	ctx, cancel := resolveContext(timeout)
+	defer cancel()
+	addresses, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("no answer for %s within %v", host, timeout)
+		}
+		return nil, &PingError{Kind: ErrResolveFailed, Err: err}
+	}
+	for _, address := range addresses {
+		if address.IP.To4() != nil {
+			return &address, nil
+		}
+	}
+	return &addresses[0], nil
+}
+
+// Returns the host name address resolves back to, or "" if it has none or the
+// lookup takes longer than timeout
+func reverseLookup(address string, timeout time.Duration) string {
+	ctx, cancel := resolveContext(timeout)
+	defer cancel()
+	names, err := net.DefaultResolver.LookupAddr(ctx, address)
+	if err != nil || len(names) == 0 {
+		return ""
+	}
+	return strings.TrimSuffix(names[0], ".")
+}
+
+// The settings of a pinger, which NewMiniPinger takes
+type Options struct {
+	// the number of packets to send
+	Count int
+	// the TTL, or the hop limit over IPv6, of the packets
+	TTL int
+	// the time between two packets
+	Interval time.Duration
+	// the size of the ICMP payload in bytes
+	PacketSize int
+	// how long to wait for the answer to each packet, an Interval if zero
+	PerPacketTimeout time.Duration
+	// how long the run lasts at most
+	Deadline time.Duration
+	// how long resolving the destination may take
+	ResolveTimeout time.Duration
+}
+
+// Creates a new mini-pinger for input, a host name or an address, with the
+// settings in opts
+func NewMiniPinger(input string, opts Options) (*MiniPinger, error) {
+	mp := new(MiniPinger)
+	ipAddress, err := resolveIPAddr(input, opts.ResolveTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if ipAddress.IP.To4() == nil && ipAddress.IP.IsLinkLocalUnicast() && ipAddress.Zone == "" {
+		return nil, &PingError{Kind: ErrInvalidArgument, Err: fmt.Errorf(
+			"%s is an IPv6 link-local address and needs a zone naming the interface, e.g. %s%%eth0", ipAddress.IP, ipAddress.IP)}
+	}
+	mp.ipAddress = ipAddress
+	mp.isIPv4 = ipAddress.IP.To4() != nil
+	if opts.PacketSize < 0 || opts.PacketSize > mp.maxPayload() {
+		return nil, &PingError{Kind: ErrInvalidArgument, Err: fmt.Errorf(
+			"packet size %d is out of range, the ICMP payload to %s can be 0 to %d bytes", opts.PacketSize, ipAddress.IP, mp.maxPayload())}
+	}
+	mp.hostname = input
+	mp.resolve = func(host string) (*net.IPAddr, error) {
+		return resolveIPAddr(host, opts.ResolveTimeout)
+	}
+	mp.lookupName = func(address string) string {
+		return reverseLookup(address, opts.ResolveTimeout)
+	}
+	mp.hopNames = make(map[string]string)
+	mp.hopLookups = make(map[string]chan struct{})
+	mp.count = opts.Count
+	mp.ttl = opts.TTL
+	mp.interval = opts.Interval
+	mp.packetSize = opts.PacketSize
+	if opts.PerPacketTimeout <= 0 {
+		opts.PerPacketTimeout = opts.Interval
+	}
+	mp.perPacketTimeout = opts.PerPacketTimeout
+	mp.totalDeadline = opts.Deadline
+	mp.finished = make(chan bool, 2)
+	mp.listenDone = mp.finished
+	mp.packetsSent = 0
+	mp.packetsReceived = 0
+	mp.timeSent = make(map[int]time.Time)
+	mp.timers = make(map[int]*time.Timer)
+	mp.initialTTLs = make(map[int]int)
+	mp.replies = make(chan *reply)
+	mp.timeouts = make(chan int)
+	mp.released = make(chan struct{}, 1)
+	mp.progress = make(chan struct{}, 1)
+	mp.packets = make([]PacketRecord, 0)
+	mp.events = json.NewEncoder(os.Stdout)
+	mp.stdout = os.Stdout
+	mp.console = os.Stdout
+	mp.latestReplied = -1
+	mp.now = time.Now
+	mp.open = mp.listen
+	mp.listenPacket = listenICMP
+	// the echo identifier is 16 bits on the wire, so only the low bits of the PID are used
+	mp.id = os.Getpid() & 0xffff
+	mp.tos = -1
+	mp.expectHops = -1
+	mp.token = make([]byte, tokenLength)
+	if _, err := rand.Read(mp.token); err != nil {
+		return nil, err
+	}
+	mp.payload = make([]byte, opts.PacketSize)
+	copy(mp.payload, mp.token)
+	return mp, nil
+}
+
+// Returns the largest echo payload for the address family of the destination
+func (mp *MiniPinger) maxPayload() int {
+	if mp.isIPv4 {
+		return maxPayloadIPv4
+	}
+	return maxPayloadIPv6
+}
+
+// Uses the contents of a file as the echo payload instead of the token-stamped
+// zeros. With size >= 0 the contents are truncated or zero-padded to size,
+// otherwise the packet size becomes the file length.
+func (mp *MiniPinger) loadPayloadFile(path string, size int) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if len(data) > mp.maxPayload() {
+		return fmt.Errorf("%s is %d bytes, larger than the maximum ICMP payload of %d bytes", path, len(data), mp.maxPayload())
+	}
+	if size < 0 {
+		size = len(data)
+	}
+	mp.packetSize = size
+	mp.payload = make([]byte, size)
+	copy(mp.payload, data)
+	mp.customPayload = true
+	return nil
+}
+
+// Fills the echo payload after the token and sequence number with the bytes
+// 0, 1, 2, ... 255, 0, ... so replies can be checked byte by byte for
+// pattern-dependent corruption on the path
+func (mp *MiniPinger) useIncrementingPattern() {
+	mp.pattern = patternInc
+	start := mp.patternStart()
+	for i := start; i < len(mp.payload); i++ {
+		mp.payload[i] = byte(i - start)
+	}
+}
+
+// Returns the payload offset where the -pattern bytes begin
+func (mp *MiniPinger) patternStart() int {
+	if mp.stampsSeq() {
+		return tokenLength + 4
+	}
+	return tokenLength
+}
+
+// Returns a note naming the first byte of a reply that differs from the
+// -pattern sent, counting the reply as corrupted, or "" if it matches as far as
+// it was echoed back
+func (mp *MiniPinger) checkPattern(data []byte) string {
+	if mp.pattern == "" {
+		return ""
+	}
+	for i := mp.patternStart(); i < len(data) && i < len(mp.payload); i++ {
+		if data[i] != mp.payload[i] {
+			mp.mu.Lock()
+			mp.corruptReplies++
+			mp.mu.Unlock()
+			return fmt.Sprintf(" (corrupted at byte %d: got 0x%02x want 0x%02x)", i, data[i], mp.payload[i])
+		}
+	}
+	return ""
+}
+
+// Starts the echo sequence numbers on the wire at a random 16-bit value instead
+// of zero, for middleboxes that cache by predictable sequence numbers
+func (mp *MiniPinger) randomizeSeqStart() error {
+	var b [2]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return err
+	}
+	mp.seqStart = int(binary.BigEndian.Uint16(b[:]))
+	return nil
+}
+
+// Returns the 16-bit sequence number packet seq carries on the wire
+func (mp *MiniPinger) wireSeq(seq int) int {
+	return (mp.seqStart + seq) & 0xffff
+}
+
+// Returns the latest packet sent with the 16-bit sequence number wire, or -1
+// if none was. Packets are numbered on from zero past the wrap at 65535, so
+// a packet is found as long as fewer than 65536 were sent after it.
+func (mp *MiniPinger) unwrapSeq(wire int) int {
+	mp.mu.Lock()
+	latest := mp.packetsSent - 1
+	mp.mu.Unlock()
+	seq := latest - (mp.wireSeq(latest)-wire)&0xffff
+	if seq < 0 {
+		return -1
+	}
+	return seq
+}
+
+// Returns the current time without its monotonic clock reading, so that
+// differences between such times follow the system clock, steps included
+func wallClock() time.Time {
+	return time.Now().Round(0)
+}
+
+// Ends the run, remembering the first reason given; later calls are no-ops
+func (mp *MiniPinger) stop(reason string) {
+	mp.stopOnce.Do(func() {
+		mp.mu.Lock()
+		mp.stopReason = reason
+		mp.mu.Unlock()
+		close(mp.finished)
+	})
+}
+
+// Replaces the process-derived echo identifier with a random 16-bit one
+func (mp *MiniPinger) randomizeID() error {
+	var b [2]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return err
+	}
+	mp.id = int(binary.BigEndian.Uint16(b[:]))
+	return nil
+}
+
+// Carries the destination and the identity of the previous -loop session over
+// to this one, which was created for the address previous resolved to: the
+// host name to re-resolve, and the echo identifier, token and payload replies
+// are matched by. The sequence numbers on the wire go on from where previous
+// stopped, so a late reply to it can't pass for one to this session.
+func (mp *MiniPinger) continueFrom(previous *MiniPinger) {
+	mp.hostname = previous.hostname
+	mp.id = previous.id
+	mp.token = previous.token
+	mp.payload = previous.payload
+	previous.mu.Lock()
+	mp.seqStart = previous.wireSeq(previous.packetsSent)
+	previous.mu.Unlock()
+}
+
+// Returns the start of the payload that replies have to echo back, which is
+// the session token unless the payload was loaded from a file
+func (mp *MiniPinger) payloadToken() []byte {
+	if len(mp.payload) < tokenLength {
+		return mp.payload
+	}
+	return mp.payload[:tokenLength]
+}
+
+// Reports whether the echo payload carries the sequence number after the
+// token, as it does unless it was loaded from a file or is too short
+func (mp *MiniPinger) stampsSeq() bool {
+	return !mp.customPayload && mp.packetSize >= tokenLength+4
+}
+
+// Returns the address currently pinged, which -reresolve may change mid-run
+func (mp *MiniPinger) destination() *net.IPAddr {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	return mp.ipAddress
+}
+
+// Resolves the destination again every -reresolve period and switches to the
+// new address when it changed, e.g. after a DNS failover. The socket only
+// speaks one address family, so addresses of the other one are ignored.
+func (mp *MiniPinger) reresolveLoop() {
+	ticker := time.NewTicker(mp.reresolve)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-mp.finished:
+			return
+		case <-ticker.C:
+		}
+		address, err := mp.resolve(mp.hostname)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "re-resolving %s: %v\n", mp.hostname, err)
+			continue
+		}
+		mp.mu.Lock()
+		previous := mp.ipAddress
+		switched := !address.IP.Equal(previous.IP) && (address.IP.To4() != nil) == mp.isIPv4
+		if switched {
+			mp.ipAddress = address
+		}
+		mp.mu.Unlock()
+		if switched {
+			fmt.Fprintf(os.Stderr, "%s now resolves to %s, was %s\n", mp.hostname, address, previous)
+		}
+	}
+}
+
+// Runs the session to the end and returns the error that aborted it, or
+// an error wrapping ErrTimeout if no packet was answered
+func (mp *MiniPinger) Run() error {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	mp.run(&wg)
+	if mp.runErr != nil {
+		return mp.runErr
+	}
+	if stats := mp.stats(); stats.Received == 0 && !mp.fireAndForget && !mp.dryRun {
+		return fmt.Errorf("%w: none of %d packets to %s answered", ErrTimeout, stats.Sent, mp.destination())
+	}
+	return nil
+}
+
+// Returns the statistics of the packets sent so far, or of the whole session
+// once Run returned
+func (mp *MiniPinger) Stats() Stats {
+	return mp.stats()
+}
+
+// main function that starts and maintains all processes
+func (mp *MiniPinger) run(wgMain *sync.WaitGroup) {
+	defer wgMain.Done()
+	// a hard limit on top of -c and -w, which holds even when a goroutine of
+	// the run wedges
+	giveUp := make(chan struct{})
+	hardStopped := make(chan struct{})
+	if mp.maxTime > 0 {
+		hardStop := time.AfterFunc(mp.maxTime, func() {
+			mp.stop(stopMaxTime)
+			close(hardStopped)
+		})
+		defer hardStop.Stop()
+		lastResort := time.AfterFunc(mp.maxTime+maxTimeGrace, func() {
+			close(giveUp)
+		})
+		defer lastResort.Stop()
+	}
+	if mp.reresolve > 0 && net.ParseIP(mp.hostname) == nil {
+		go mp.reresolveLoop()
+	}
+	if mp.report > 0 {
+		go mp.reportLoop()
+	}
+	if mp.alerter != nil && mp.monitor {
+		go mp.watchBreaches()
+	}
+	if mp.buffered != nil {
+		go mp.flushLoop()
+		defer mp.flushOutput()
+	}
+	if mp.tcpPort != 0 && mp.dryRun {
+		// connecting would already be a probe
+		fmt.Fprintf(mp.stdout, "dry run: would connect to %s port %d, %s\n", mp.destination(), mp.tcpPort, mp.plan())
+		return
+	}
+	if mp.tcpPort != 0 {
+		mp.runTCP()
+		return
+	}
+	conn, mode, err := mp.open()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		mp.runErr = classifyError(err)
+		return
+	}
+	defer conn.Close()
+	if mp.verbose {
+		fmt.Fprintf(os.Stderr, "using a %s ICMP socket\n", mode)
+	}
+	if mode == modeDatagram && mp.isIPv4 && mp.tos >= 0 {
+		// a datagram socket hands over the ICMP message without the IP
+		// header the reply TOS is read from
+		err := &PingError{Kind: ErrPermissionDenied, Err: errors.New(
+			"-Q checks the reply TOS, which over IPv4 needs a raw ICMP socket")}
+		fmt.Fprintln(os.Stderr, err)
+		mp.runErr = err
+		return
+	}
+	if mp.socketReceiveBuffer > 0 {
+		granted, err := setReceiveBuffer(packetConn(conn, mp.isIPv4), mp.socketReceiveBuffer)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: can't set the socket receive buffer: %v\n", err)
+		} else {
+			fmt.Fprintf(os.Stderr, "socket receive buffer: %d bytes (asked for %d)\n", granted, mp.socketReceiveBuffer)
+		}
+	}
+	if mp.kernelTimestamps {
+		if err := enableTimestamping(packetConn(conn, mp.isIPv4)); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: can't enable receive timestamps, timing in userspace: %v\n", err)
+			mp.kernelTimestamps = false
+		}
+	}
+	if mp.ipIDs && mp.datagram {
+		fmt.Fprintln(os.Stderr, "warning: -ipid needs raw sockets and is off")
+		mp.ipIDs = false
+	}
+	if mp.ipIDs {
+		if headerConn, err := openHeaderConn(); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: can't send with our own IP headers, -ipid is off: %v\n", err)
+			mp.ipIDs = false
+		} else {
+			mp.headerConn = headerConn
+			defer headerConn.Close()
+		}
+	}
+	if mp.isIPv4 {
+		conn.IPv4PacketConn().SetControlMessage(ipv4.FlagTTL, true)
+		if mp.showSrc {
+			conn.IPv4PacketConn().SetControlMessage(ipv4.FlagDst, true)
+		}
+		if mp.tos >= 0 {
+			conn.IPv4PacketConn().SetTOS(mp.tos)
+		}
+	} else {
+		conn.IPv6PacketConn().SetControlMessage(ipv6.FlagHopLimit, true)
+		if mp.showSrc {
+			conn.IPv6PacketConn().SetControlMessage(ipv6.FlagDst, true)
+		}
+		if mp.tos >= 0 {
+			conn.IPv6PacketConn().SetControlMessage(ipv6.FlagTrafficClass, true)
+			conn.IPv6PacketConn().SetTrafficClass(mp.tos)
+		}
+	}
+	if mp.via != nil {
+		if err := setSourceRoute(packetConn(conn, true), mp.via); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			mp.runErr = err
+			return
+		}
+		fmt.Fprintf(os.Stderr, "routing via gateway %s (loose source route)\n", mp.via)
+	}
+	send := func() {
+		mp.checkSend(mp.sendPacket(conn))
+	}
+	if mp.udpPort != 0 {
+		udpConn, err := net.ListenUDP("udp", nil)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			mp.runErr = classifyError(err)
+			return
+		}
+		defer udpConn.Close()
+		mp.udpSourcePort = udpConn.LocalAddr().(*net.UDPAddr).Port
+		if mp.via != nil {
+			if err := setSourceRoute(udpConn, mp.via); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				mp.runErr = err
+				return
+			}
+		}
+		send = func() {
+			mp.checkSend(mp.sendUDPProbe(udpConn))
+		}
+	}
+	if mp.dryRun {
+		if err := mp.checkSetup(conn); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			mp.runErr = classifyError(err)
+			return
+		}
+		via := ""
+		if mp.via != nil {
+			via = " via gateway " + mp.via.String()
+		}
+		fmt.Fprintf(mp.stdout, "dry run: would ping %s%s over a %s ICMP socket, %s\n", mp.destination(), via, mode, mp.plan())
+		return
+	}
+	if mp.drain > 0 && !mp.fireAndForget {
+		mp.listenDone = make(chan bool)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go mp.checkFinish(&wg)
+	if !mp.fireAndForget {
+		wg.Add(2)
+		go mp.receivePacket(conn, &wg)
+		go mp.matchReplies(&wg)
+	}
+	mp.sendLoop(send)
+	if mp.listenDone != mp.finished {
+		// keep listening for the replies still on their way when the run
+		// stopped, unless -maxtime or an interrupt cuts that short. An
+		// interrupt that stopped the run is what asked for the drain.
+		interrupted := mp.interrupted
+		mp.mu.Lock()
+		if mp.stopReason == stopInterrupted {
+			interrupted = nil
+		}
+		mp.mu.Unlock()
+		drain := time.NewTimer(mp.drain)
+		select {
+		case <-drain.C:
+		case <-interrupted:
+		case <-hardStopped:
+		}
+		drain.Stop()
+		close(mp.listenDone)
+	}
+	// unblock a pending read right away instead of waiting for its deadline
+	conn.SetReadDeadline(time.Now())
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-giveUp:
+		fmt.Fprintln(os.Stderr, "warning: the run didn't wind down within -maxtime, giving up on it")
+		// closing the socket ends a read that wedged, and the matcher then
+		// runs out of replies; the summary waits a little for both so it
+		// doesn't race them
+		conn.Close()
+		select {
+		case <-done:
+		case <-time.After(maxTimeGrace):
+			fmt.Fprintln(os.Stderr, "warning: the reader or the matcher is still running, the summary may be off")
+		}
+	}
+}
+
+// Applies the per-packet socket options a -dry-run would otherwise only set
+// on the first send, the TTL and the TOS, to find out whether they are allowed
+func (mp *MiniPinger) checkSetup(conn icmpConn) error {
+	if err := mp.setTTL(conn, mp.ttlFor(0)); err != nil {
+		return fmt.Errorf("can't set the TTL: %v", err)
+	}
+	if mp.tos < 0 {
+		return nil
+	}
+	var err error
+	if mp.isIPv4 {
+		err = conn.IPv4PacketConn().SetTOS(mp.tos)
+	} else {
+		err = conn.IPv6PacketConn().SetTrafficClass(mp.tos)
+	}
+	if err != nil {
+		return fmt.Errorf("can't set the TOS: %v", err)
+	}
+	return nil
+}
+
+// Describes the packets a -dry-run would have sent
+func (mp *MiniPinger) plan() string {
+	packets := fmt.Sprintf("packets of %d bytes every %v with ttl %d", mp.packetSize, mp.interval, mp.ttlFor(0))
+	if mp.hasCount() {
+		packets = fmt.Sprintf("%d %s", mp.count, packets)
+	} else {
+		packets += " until stopped"
+	}
+	return packets + "; nothing sent"
+}
+
+// Ends the run once one of the terminating conditions is met, looking again
+// whenever a packet is sent or settled and when the deadline passes
+func (mp *MiniPinger) checkFinish(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	startTime := mp.now()
+	mp.mu.Lock()
+	mp.startTime = startTime
+	mp.mu.Unlock()
+	deadline := time.NewTimer(mp.totalDeadline)
+	defer deadline.Stop()
+	for {
+		mp.mu.Lock()
+		sent := mp.packetsSent
+		outstanding := mp.outstanding
+		bytesSent := mp.bytesSent
+		mp.mu.Unlock()
+		// without reply tracking there's nothing to wait for after the last send
+		if sent >= mp.count && (outstanding == 0 || mp.fireAndForget) {
+			mp.stop(stopCount)
+			return
+		}
+		if mp.maxBytes > 0 && bytesSent >= mp.maxBytes {
+			mp.stop(stopBytes)
+			return
+		}
+		select {
+		case <-mp.finished:
+			return
+		case <-deadline.C:
+			mp.stop(stopDeadline)
+			return
+		case <-mp.progress:
+		}
+	}
+}
+
+// Wakes checkFinish up to look at the counts again
+func (mp *MiniPinger) signalProgress() {
+	select {
+	case mp.progress <- struct{}{}:
+	default:
+	}
+}
+
+// Reports whether a packet count was requested with -c
+func (mp *MiniPinger) hasCount() bool {
+	return mp.count != math.MaxInt32
+}
+
+// Reports whether a deadline was requested with -w
+func (mp *MiniPinger) hasDeadline() bool {
+	return mp.totalDeadline != time.Duration(math.MaxInt32)*time.Second
+}
+
+// Returns how many packets a -for run sends at the configured interval
+func (mp *MiniPinger) expectedPackets() int {
+	if mp.interval <= 0 {
+		return 0
+	}
+	return int(mp.duration / mp.interval)
+}
@@ -0,0 +1,676 @@
+package miniping
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Returns a pinger to target, which must be an address literal, sending two
+// packets 10ms apart within a deadline of 10s, with an identifier that fits
+// the 16 bits of the echo header whatever the process ID
+func testPinger(target string) *MiniPinger {
+	mp, err := NewMiniPinger(target, Options{
+		Count:      2,
+		TTL:        64,
+		Interval:   10 * time.Millisecond,
+		PacketSize: 56,
+		Deadline:   10 * time.Second,
+	})
+	if err != nil {
+		panic(err)
+	}
+	mp.id = 0x1234
+	return mp
+}
+
+// An ICMP socket standing in for the network: what the pinger reads comes in
+// over loopback UDP from peer, so a test can hand it any message, and what it
+// sends is noted and, for the addresses that are up, answered
+type fakeConn struct {
+	*net.UDPConn
+	p4   *ipv4.PacketConn
+	peer *net.UDPConn
+	mu   sync.Mutex
+	// the socket TTL each request went out with
+	ttls []int
+	// the addresses answering echo requests
+	up map[string]bool
+	// how long the answers take
+	delay time.Duration
+}
+
+// Returns a fakeConn closed when the test ends
+func newFakeConn(t *testing.T) *fakeConn {
+	c, err := openFakeConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+	})
+	return c
+}
+
+// Returns a fakeConn for the caller to close, answering for the addresses in up
+func openFakeConn(up ...string) (*fakeConn, error) {
+	loopback := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	conn, err := net.ListenUDP("udp4", loopback)
+	if err != nil {
+		return nil, err
+	}
+	peer, err := net.ListenUDP("udp4", loopback)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c := &fakeConn{UDPConn: conn, p4: ipv4.NewPacketConn(conn), peer: peer, up: map[string]bool{}}
+	for _, address := range up {
+		c.up[address] = true
+	}
+	return c, nil
+}
+
+// Hands m to the pinger as if it came in from the network
+func (c *fakeConn) deliver(t *testing.T, m *icmp.Message) {
+	b, err := m.Marshal(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.peer.WriteTo(b, c.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *fakeConn) WriteTo(b []byte, to net.Addr) (int, error) {
+	ttl, err := c.p4.TTL()
+	if err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	c.ttls = append(c.ttls, ttl)
+	host := to.String()
+	if udp, ok := to.(*net.UDPAddr); ok {
+		// a datagram socket's destination
+		host = udp.IP.String()
+	}
+	up, delay := c.up[host], c.delay
+	c.mu.Unlock()
+	m, err := icmp.ParseMessage(1, b)
+	if err != nil {
+		return 0, err
+	}
+	if echo, ok := m.Body.(*icmp.Echo); ok && m.Type == ipv4.ICMPTypeEcho && up {
+		answer, err := (&icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: echo}).Marshal(nil)
+		if err != nil {
+			return 0, err
+		}
+		time.AfterFunc(delay, func() {
+			// the run may be over and the socket closed by now
+			c.peer.WriteTo(answer, c.LocalAddr())
+		})
+	}
+	return len(b), nil
+}
+
+func (c *fakeConn) IPv4PacketConn() *ipv4.PacketConn {
+	return c.p4
+}
+
+func (c *fakeConn) IPv6PacketConn() *ipv6.PacketConn {
+	return nil
+}
+
+func (c *fakeConn) Close() error {
+	c.peer.Close()
+	return c.UDPConn.Close()
+}
+
+// Has mp run on conn instead of an ICMP socket
+func useConn(mp *MiniPinger, conn icmpConn) {
+	mp.open = func() (icmpConn, string, error) {
+		return conn, modeRaw, nil
+	}
+}
+
+// Returns what f writes to stderr
+func captureStderr(t *testing.T, f func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	stderr := os.Stderr
+	os.Stderr = w
+	f()
+	os.Stderr = stderr
+	w.Close()
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+// The identifier is the low 16 bits of the PID, which is what a reply to a
+// request sent with a PID past 16 bits carries
+func TestIDIsLowBitsOfPID(t *testing.T) {
+	mp, err := NewMiniPinger("192.0.2.1", Options{Count: 1, TTL: 64, Interval: time.Second, PacketSize: 56, Deadline: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := os.Getpid() & 0xffff; mp.id != want {
+		t.Errorf("identifier %d, want %d", mp.id, want)
+	}
+	// a PID too large for the header, with the same low bits
+	request := icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &icmp.Echo{ID: os.Getpid() | 0x10000, Seq: 0, Data: mp.payload}}
+	b, err := request.Marshal(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := icmp.ParseMessage(1, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mp.isOwnReply(m.Body.(*icmp.Echo)) {
+		t.Error("reply carrying the low 16 bits of the PID rejected")
+	}
+}
+
+// -reresolve follows the destination to the address it resolves to now,
+// staying with its address family
+func TestReresolve(t *testing.T) {
+	mp := testPinger("192.0.2.1")
+	mp.hostname = "failover.example"
+	mp.reresolve = 5 * time.Millisecond
+	var mu sync.Mutex
+	answers := []string{"192.0.2.1", "192.0.2.2", "2001:db8::2"}
+	mp.resolve = func(host string) (*net.IPAddr, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if host != "failover.example" {
+			t.Errorf("resolved %s", host)
+		}
+		address := answers[0]
+		if len(answers) > 1 {
+			answers = answers[1:]
+		}
+		return &net.IPAddr{IP: net.ParseIP(address)}, nil
+	}
+	done := make(chan struct{})
+	go func() {
+		mp.reresolveLoop()
+		close(done)
+	}()
+	deadline := time.Now().Add(time.Second)
+	for {
+		mu.Lock()
+		exhausted := len(answers) == 1
+		mu.Unlock()
+		if exhausted || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	// one more round with the IPv6 answer
+	time.Sleep(20 * time.Millisecond)
+	mp.stop(stopCount)
+	<-done
+	if got := mp.destination().String(); got != "192.0.2.2" {
+		t.Errorf("pinging %s, want the new address 192.0.2.2", got)
+	}
+}
+
+// Replies arriving after the deadline stopped the run are only counted
+// during a -drain
+func TestDrain(t *testing.T) {
+	tests := []struct {
+		drain             time.Duration
+		received, drained int
+	}{
+		{0, 0, 0},
+		{time.Second, 1, 1},
+	}
+	for _, tt := range tests {
+		mp := testPinger("127.0.0.1")
+		mp.count = 1
+		// sent after an interval, answered after the deadline
+		mp.interval = 100 * time.Millisecond
+		mp.perPacketTimeout = mp.interval
+		mp.totalDeadline = 150 * time.Millisecond
+		mp.drain = tt.drain
+		conn := newFakeConn(t)
+		conn.up["127.0.0.1"] = true
+		conn.delay = 100 * time.Millisecond
+		useConn(mp, conn)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		// the reply is in by the time the drain is cut short
+		mp.interrupted = make(chan bool)
+		time.AfterFunc(400*time.Millisecond, func() {
+			close(mp.interrupted)
+		})
+		mp.run(&wg)
+		stats := mp.stats()
+		if stats.StopReason != stopDeadline {
+			t.Errorf("drain %v: stopped by %s, want the deadline", tt.drain, stats.StopReason)
+		}
+		if stats.Received != tt.received || stats.Drained != tt.drained {
+			t.Errorf("drain %v: received %d, %d during the drain, want %d and %d",
+				tt.drain, stats.Received, stats.Drained, tt.received, tt.drained)
+		}
+	}
+}
+
+// Returns the echo payload mp sends with packet seq
+func echoData(mp *MiniPinger, seq int) []byte {
+	data := make([]byte, mp.packetSize)
+	copy(data, mp.payload)
+	binary.BigEndian.PutUint32(data[tokenLength:], uint32(seq))
+	return data
+}
+
+// -bytes stops the run with the packet that reaches the byte count
+func TestByteLimit(t *testing.T) {
+	mp := testPinger("127.0.0.1")
+	mp.count = 100
+	mp.interval = 20 * time.Millisecond
+	// four 64 byte messages, the fourth going past it
+	mp.maxBytes = 200
+	conn := newFakeConn(t)
+	conn.up["127.0.0.1"] = true
+	useConn(mp, conn)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	mp.run(&wg)
+	stats := mp.stats()
+	if stats.StopReason != stopBytes || stats.Sent != 4 || stats.BytesSent != 256 {
+		t.Errorf("stopped by %s after %d packets, %d bytes, want %s after 4 and 256",
+			stats.StopReason, stats.Sent, stats.BytesSent, stopBytes)
+	}
+}
+
+// A socket whose sends all fail with err
+type failingConn struct {
+	*fakeConn
+	err error
+}
+
+func (c *failingConn) WriteTo(b []byte, to net.Addr) (int, error) {
+	return 0, &net.OpError{Op: "write", Net: "ip4:icmp", Err: os.NewSyscallError("sendto", c.err)}
+}
+
+// The errors of NewMiniPinger and Run match the kind of failure with errors.Is
+// and still carry their cause
+func TestErrorKinds(t *testing.T) {
+	_, err := NewMiniPinger("host.invalid", Options{Count: 1, Interval: time.Second, Deadline: time.Second})
+	if !errors.Is(err, ErrResolveFailed) {
+		t.Errorf("resolving: %v, want ErrResolveFailed", err)
+	}
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) {
+		t.Errorf("resolving: %v doesn't wrap the resolver error", err)
+	}
+
+	tests := []struct {
+		name string
+		open func(t *testing.T) (icmpConn, error)
+		want error
+	}{
+		{"socket refused", func(t *testing.T) (icmpConn, error) {
+			return nil, os.NewSyscallError("socket", syscall.EPERM)
+		}, ErrPermissionDenied},
+		{"network unreachable", func(t *testing.T) (icmpConn, error) {
+			return &failingConn{newFakeConn(t), syscall.ENETUNREACH}, nil
+		}, ErrNoRoute},
+		{"no replies", func(t *testing.T) (icmpConn, error) {
+			return newFakeConn(t), nil
+		}, ErrTimeout},
+	}
+	for _, tt := range tests {
+		mp := testPinger("127.0.0.1")
+		mp.unreachableAfter = 2
+		mp.open = func() (icmpConn, string, error) {
+			conn, err := tt.open(t)
+			return conn, modeRaw, err
+		}
+		if err := mp.Run(); !errors.Is(err, tt.want) {
+			t.Errorf("%s: %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+// Resolving gives up after -resolve-timeout on a resolver that never answers
+func TestResolveTimeout(t *testing.T) {
+	defer func(resolver *net.Resolver) {
+		net.DefaultResolver = resolver
+	}(net.DefaultResolver)
+	net.DefaultResolver = &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}}
+	start := time.Now()
+	_, err := resolveIPAddr("unanswered.example", 50*time.Millisecond)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("resolving gave up after %v, want 50ms", elapsed)
+	}
+	if !errors.Is(err, ErrResolveFailed) || !strings.Contains(err.Error(), "within 50ms") {
+		t.Errorf("error %v, want a resolve timeout", err)
+	}
+}
+
+// -maxtime ends a run nothing answers, even without a deadline
+func TestMaxTime(t *testing.T) {
+	mp := testPinger("127.0.0.1")
+	mp.count = math.MaxInt32
+	mp.totalDeadline = math.MaxInt64
+	mp.maxTime = 100 * time.Millisecond
+	useConn(mp, newFakeConn(t))
+	start := time.Now()
+	mp.Run()
+	if elapsed := time.Since(start); elapsed < mp.maxTime || elapsed > mp.maxTime+maxTimeGrace {
+		t.Errorf("ran for %v, want %v", elapsed, mp.maxTime)
+	}
+	if stats := mp.Stats(); stats.StopReason != stopMaxTime || stats.Received != 0 {
+		t.Errorf("stopped by %s with %d replies, want %s and none", stats.StopReason, stats.Received, stopMaxTime)
+	}
+}
+
+// A reply differing from the -pattern inc payload is flagged at the first
+// byte that differs and counted as corrupted
+func TestIncrementingPattern(t *testing.T) {
+	mp := testPinger("192.0.2.1")
+	var out strings.Builder
+	mp.stdout = &out
+	mp.useIncrementingPattern()
+	if start := mp.patternStart(); mp.payload[start] != 0 || mp.payload[start+5] != 5 {
+		t.Fatalf("pattern % x", mp.payload[start:])
+	}
+	mp.markSent(0)
+	mp.markSent(1)
+	corrupted := echoData(mp, 1)
+	corrupted[40] ^= 0xff
+	for seq, data := range [][]byte{echoData(mp, 0), corrupted} {
+		mp.handleReply(&reply{message: &icmp.Message{Type: ipv4.ICMPTypeEchoReply,
+			Body: &icmp.Echo{ID: mp.id, Seq: seq, Data: data}}, receivedAt: time.Now()})
+	}
+	mp.stop(stopCount)
+	lines := strings.Split(out.String(), "\n")
+	if strings.Contains(lines[0], "corrupted") {
+		t.Errorf("intact reply flagged: %q", lines[0])
+	}
+	if want := "(corrupted at byte 40: got 0xe3 want 0x1c)"; !strings.Contains(lines[1], want) {
+		t.Errorf("reply %q, want the note %q", lines[1], want)
+	}
+	if stats := mp.stats(); stats.Received != 2 || stats.Corrupted != 1 {
+		t.Errorf("%d replies, %d corrupted, want 2 and 1", stats.Received, stats.Corrupted)
+	}
+}
+
+// -W sets how long a packet is waited for, which is the interval unless given
+func TestPerPacketTimeout(t *testing.T) {
+	tests := []struct {
+		timeout, want time.Duration
+	}{
+		{0, time.Second},
+		{30 * time.Millisecond, 30 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		mp, err := NewMiniPinger("192.0.2.1", Options{Count: 1, Interval: time.Second,
+			PerPacketTimeout: tt.timeout, Deadline: 10 * time.Second})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mp.perPacketTimeout != tt.want || mp.totalDeadline != 10*time.Second {
+			t.Errorf("-W %v: timeout %v and deadline %v, want %v and 10s", tt.timeout, mp.perPacketTimeout, mp.totalDeadline, tt.want)
+		}
+	}
+	// a packet times out after -W, not after the interval
+	mp, err := NewMiniPinger("192.0.2.1", Options{Count: 1, Interval: time.Hour,
+		PerPacketTimeout: 20 * time.Millisecond, Deadline: 10 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp.markSent(0)
+	select {
+	case seq := <-mp.timeouts:
+		if seq != 0 {
+			t.Errorf("packet %d timed out, want 0", seq)
+		}
+	case <-time.After(time.Second):
+		t.Error("the packet didn't time out")
+	}
+	mp.stop(stopCount)
+}
+
+// Sequence numbers on the wire map back to the latest packet sent with them
+func TestUnwrapSeq(t *testing.T) {
+	tests := []struct {
+		seqStart int
+		sent     int
+		wire     int
+		want     int
+	}{
+		{0, 10, 3, 3},
+		{0, 10, 9, 9},
+		// not sent yet
+		{0, 10, 12, -1},
+		// past the wrap at 65535
+		{0, 70000, 69999 & 0xffff, 69999},
+		{0, 70000, 65535, 65535},
+		// -loop carrying on from an earlier session
+		{65530, 10, 3, 9},
+		{65530, 10, 65531, 1},
+	}
+	for _, tt := range tests {
+		mp := testPinger("192.0.2.1")
+		mp.seqStart = tt.seqStart
+		mp.packetsSent = tt.sent
+		if got := mp.unwrapSeq(tt.wire); got != tt.want {
+			t.Errorf("seq start %d, %d sent: wire seq %d unwraps to %d, want %d", tt.seqStart, tt.sent, tt.wire, got, tt.want)
+		}
+	}
+}
+
+// Replies are matched across the wrap of the 16-bit sequence number
+func TestRandomSeqWraps(t *testing.T) {
+	mp := testPinger("192.0.2.1")
+	mp.stdout = io.Discard
+	mp.seqStart = 65534
+	for seq := 0; seq < 4; seq++ {
+		mp.markSent(seq)
+	}
+	for seq := 0; seq < 4; seq++ {
+		mp.handleReply(&reply{message: &icmp.Message{Type: ipv4.ICMPTypeEchoReply,
+			Body: &icmp.Echo{ID: mp.id, Seq: mp.wireSeq(seq), Data: echoData(mp, seq)}}, receivedAt: time.Now()})
+	}
+	mp.stop(stopCount)
+	for _, record := range mp.stats().Packets {
+		if record.Status != statusReplied {
+			t.Errorf("packet %d (wire seq %d) %s, want replied", record.Seq, mp.wireSeq(record.Seq), record.Status)
+		}
+	}
+}
+
+// Returns the echo reply the destination sends to packet seq of mp
+func echoReply(mp *MiniPinger, seq int) *icmp.Message {
+	return &icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &icmp.Echo{ID: mp.id, Seq: mp.wireSeq(seq), Data: echoData(mp, seq)}}
+}
+
+// RTTs follow the monotonic clock by default, and the system clock, steps
+// included, with -wallclock
+func TestRTTClock(t *testing.T) {
+	// the send and the reply a second apart, with the system clock stepped
+	// back an hour in between, which only a clock without monotonic
+	// readings sees
+	sent := wallClock()
+	stepped := []time.Time{sent, sent.Add(time.Second - time.Hour)}
+	tests := []struct {
+		name  string
+		now   func() time.Time
+		check func(time.Duration) bool
+	}{
+		{"monotonic by default", testPinger("192.0.2.1").now, func(rtt time.Duration) bool { return rtt >= 0 }},
+		{"stepped wall clock", func() time.Time {
+			now := stepped[0]
+			stepped = stepped[1:]
+			return now
+		}, func(rtt time.Duration) bool { return rtt == time.Second-time.Hour }},
+	}
+	for _, tt := range tests {
+		mp := testPinger("192.0.2.1")
+		mp.now = tt.now
+		mp.markSent(0)
+		rtt, ok := mp.recordReply(0, &reply{message: echoReply(mp, 0), receivedAt: mp.now()})
+		if !ok || !tt.check(rtt) {
+			t.Errorf("%s: rtt %v", tt.name, rtt)
+		}
+	}
+	if now := testPinger("192.0.2.1").now(); now == now.Round(0) {
+		t.Error("the default clock has no monotonic reading")
+	}
+}
+
+// A run whose packets are all answered ends with the last reply, not with
+// the tick after it
+func TestRunEndsWithLastReply(t *testing.T) {
+	mp := testPinger("127.0.0.1")
+	mp.stdout = io.Discard
+	mp.interval = 100 * time.Millisecond
+	conn := newFakeConn(t)
+	conn.up["127.0.0.1"] = true
+	useConn(mp, conn)
+	start := time.Now()
+	if err := mp.Run(); err != nil {
+		t.Fatal(err)
+	}
+	// sent at 100ms and 200ms, and answered right away
+	if elapsed := time.Since(start); elapsed > 280*time.Millisecond {
+		t.Errorf("the run took %v, want about 200ms", elapsed)
+	}
+	if stats := mp.Stats(); stats.StopReason != stopCount || stats.Sent != 2 || stats.Received != 2 {
+		t.Errorf("stopped by %s after %d sent, %d received, want %s after 2 and 2",
+			stats.StopReason, stats.Sent, stats.Received, stopCount)
+	}
+}
+
+// A fakeConn whose destination never answers the echo request number drop,
+// counting from 0
+type droppingConn struct {
+	*fakeConn
+	drop     int
+	mu       sync.Mutex
+	requests int
+}
+
+func (c *droppingConn) WriteTo(b []byte, to net.Addr) (int, error) {
+	c.mu.Lock()
+	request := c.requests
+	c.requests++
+	c.mu.Unlock()
+	if m, err := icmp.ParseMessage(1, b); err == nil && m.Type == ipv4.ICMPTypeEcho && request == c.drop {
+		return len(b), nil
+	}
+	return c.fakeConn.WriteTo(b, to)
+}
+
+// The packet size is bounded by what fits in an IP datagram after the headers
+func TestPacketSizeLimit(t *testing.T) {
+	tests := []struct {
+		target string
+		size   int
+		ok     bool
+	}{
+		{"192.0.2.1", 65507, true},
+		{"192.0.2.1", 65508, false},
+		{"2001:db8::1", 65527, true},
+		{"2001:db8::1", 65528, false},
+		{"192.0.2.1", 0, true},
+		{"192.0.2.1", -1, false},
+	}
+	for _, tt := range tests {
+		mp, err := NewMiniPinger(tt.target, Options{Count: 1, Interval: time.Second, PacketSize: tt.size, Deadline: time.Second})
+		if tt.ok {
+			if err != nil || len(mp.payload) != tt.size {
+				t.Errorf("%d bytes to %s: %v", tt.size, tt.target, err)
+			}
+		} else if !errors.Is(err, ErrInvalidArgument) {
+			t.Errorf("%d bytes to %s: %v, want ErrInvalidArgument", tt.size, tt.target, err)
+		}
+	}
+}
+
+// A -dry-run opens the socket and sets its options, then stops without sending
+func TestDryRun(t *testing.T) {
+	mp := testPinger("127.0.0.1")
+	mp.dryRun = true
+	mp.ttl = 7
+	var out bytes.Buffer
+	mp.stdout = &out
+	conn := newFakeConn(t)
+	conn.up["127.0.0.1"] = true
+	useConn(mp, conn)
+	if err := mp.Run(); err != nil {
+		t.Fatal(err)
+	}
+	conn.mu.Lock()
+	sent := len(conn.ttls)
+	conn.mu.Unlock()
+	stats := mp.Stats()
+	if sent != 0 || stats.Sent != 0 {
+		t.Errorf("%d packets written, %d counted as sent, want none", sent, stats.Sent)
+	}
+	if want := "dry run: would ping 127.0.0.1 over a raw ICMP socket, 2 packets of 56 bytes every 10ms with ttl 7; nothing sent\n"; out.String() != want {
+		t.Errorf("printed %q, want %q", out.String(), want)
+	}
+	if code := mp.exitCode(stats); code != exitSuccess {
+		t.Errorf("exit code %d, want %d", code, exitSuccess)
+	}
+}
+
+// OnReply gets each reply and OnTimeout each lost packet as the run goes
+func TestCallbacks(t *testing.T) {
+	mp := testPinger("127.0.0.1")
+	mp.stdout = io.Discard
+	mp.count = 3
+	mp.interval = 20 * time.Millisecond
+	mp.perPacketTimeout = 60 * time.Millisecond
+	conn := newFakeConn(t)
+	conn.up["127.0.0.1"] = true
+	useConn(mp, &droppingConn{fakeConn: conn, drop: 1})
+	var replies []PacketResult
+	var timeouts []int
+	mp.OnReply = func(result PacketResult) {
+		replies = append(replies, result)
+	}
+	mp.OnTimeout = func(seq int) {
+		timeouts = append(timeouts, seq)
+	}
+	start := time.Now()
+	if err := mp.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if len(replies) != 2 || !reflect.DeepEqual(timeouts, []int{1}) {
+		t.Fatalf("replies %+v and timeouts %v, want 0 and 2 answered and 1 timed out", replies, timeouts)
+	}
+	for i, r := range replies {
+		if r.Seq != 2*i || r.From != "127.0.0.1" || r.Bytes != 8+mp.packetSize || r.RTT <= 0 || r.ReceivedAt.Before(start) {
+			t.Errorf("reply %d: %+v", i, r)
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package miniping
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Host states reported in -monitor mode; the state is empty until the first transition
+const (
+	hostUp   = "up"
+	hostDown = "down"
+)
+
+// Writes a single event line; each line goes straight to stdout so a collector sees it immediately
+func (mp *MiniPinger) emit(e event) {
+	mp.eventsMu.Lock()
+	defer mp.eventsMu.Unlock()
+	mp.events.Encode(e)
+}
+
+// Reports whether each packet gets a line of its own; -monitor only prints
+// state changes and -q only the summary
+func (mp *MiniPinger) perPacketOutput() bool {
+	return !mp.monitor && !mp.quiet && !mp.avgOnly
+}
+
+// Reports whether lines for timeouts and unparseable messages are printed,
+// which -quiet-errors drops while keeping the replies
+func (mp *MiniPinger) errorOutput() bool {
+	return mp.perPacketOutput() && !mp.quietErrors
+}
+
+// The fields of a reply a -format template can use
+type replyFields struct {
+	Seq   int
+	Bytes int
+	From  string
+	TTL   int
+	RTT   time.Duration
+}
+
+// Parses a -format template and tries it on an empty reply, so that a
+// misspelled field is reported before the run rather than on every reply
+func parseFormat(text string) (*template.Template, error) {
+	format, err := template.New("format").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if err := format.Execute(io.Discard, replyFields{}); err != nil {
+		return nil, err
+	}
+	return format, nil
+}
+
+// Prints a reply line from the -format template
+func (mp *MiniPinger) printFormatted(fields replyFields) {
+	var line bytes.Buffer
+	if err := mp.format.Execute(&line, fields); err != nil {
+		fmt.Fprintln(os.Stderr, "format error:", err)
+		return
+	}
+	fmt.Fprintln(mp.stdout, line.String())
+}
+
+// Feeds the outcome of packet seq into the -monitor state and prints a
+// timestamped line when the host goes up or down, or under -jsonl emits an
+// up or down event for seq
+func (mp *MiniPinger) observe(seq int, answered bool) {
+	if !mp.monitor {
+		return
+	}
+	mp.mu.Lock()
+	state := mp.hostState
+	if answered {
+		mp.consecutiveReplies++
+		mp.consecutiveLosses = 0
+		if mp.consecutiveReplies >= mp.upAfter {
+			state = hostUp
+		}
+	} else {
+		mp.consecutiveLosses++
+		mp.consecutiveReplies = 0
+		if mp.consecutiveLosses >= mp.downAfter {
+			state = hostDown
+		}
+	}
+	changed := state != mp.hostState
+	mp.hostState = state
+	losses := mp.consecutiveLosses
+	mp.mu.Unlock()
+	if !changed {
+		return
+	}
+	if mp.jsonl {
+		transition := event{Type: state, Time: mp.now(), Seq: seq}
+		if state == hostDown {
+			transition.ConsecutiveLost = losses
+		}
+		mp.emit(transition)
+		return
+	}
+	stamp := mp.now().Format(time.RFC3339)
+	if state == hostUp {
+		fmt.Fprintf(mp.stdout, "%s %s is up\n", stamp, mp.destination())
+	} else {
+		fmt.Fprintf(mp.stdout, "%s %s is down after %d lost packets\n", stamp, mp.destination(), losses)
+	}
+}
+
+// Returns where summaries go: stdout, unless it carries the -jsonl event stream
+func (mp *MiniPinger) summaryOutput() io.Writer {
+	if mp.jsonl && !mp.eventSocket {
+		return mp.roundWriter(os.Stderr)
+	}
+	return mp.stdout
+}
+
+// Sets the -loop round of this session, which then prefixes every line
+// printed, starting at 1
+func (mp *MiniPinger) setRound(round int) {
+	mp.round = round
+	mp.stdout = mp.roundWriter(mp.console)
+}
+
+// Buffers everything this session prints on stdout in buffered, which wraps
+// its stdout, and writes it out every period instead of line by line, which
+// saves a write per packet at high rates
+func (mp *MiniPinger) bufferOutput(buffered *flushingWriter, period time.Duration) {
+	mp.buffered = buffered
+	mp.flushEvery = period
+	mp.console = mp.buffered
+	mp.stdout = mp.roundWriter(mp.console)
+	if !mp.eventSocket {
+		mp.events = json.NewEncoder(mp.buffered)
+	}
+}
+
+// Writes out the output buffered under -flush every period until the run stops
+func (mp *MiniPinger) flushLoop() {
+	ticker := time.NewTicker(mp.flushEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-mp.finished:
+			return
+		case <-ticker.C:
+			mp.flushOutput()
+		}
+	}
+}
+
+// Writes out whatever output is buffered under -flush
+func (mp *MiniPinger) flushOutput() {
+	if mp.buffered != nil {
+		mp.buffered.Flush()
+	}
+}
+
+// Size of the -flush buffer, which is written out when full even before its
+// period is up
+const flushSize = 64 * 1024
+
+// Buffers stdout under -flush for all the pingers of a run, which share it
+// with their senders, receivers and flushers, and only ever writes out whole
+// lines, so the lines of one pinger never split those of another
+type flushingWriter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	buf []byte
+}
+
+func newFlushingWriter(w io.Writer) *flushingWriter {
+	return &flushingWriter{w: w, buf: make([]byte, 0, flushSize)}
+}
+
+func (f *flushingWriter) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.buf = append(f.buf, b...)
+	if len(f.buf) >= flushSize {
+		if err := f.writeLines(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+func (f *flushingWriter) Flush() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.writeLines()
+}
+
+// Writes out the complete lines buffered and keeps a line still being
+// written. The caller must hold f.mu.
+func (f *flushingWriter) writeLines() error {
+	end := bytes.LastIndexByte(f.buf, '\n') + 1
+	if end == 0 {
+		return nil
+	}
+	_, err := f.w.Write(f.buf[:end])
+	f.buf = append(f.buf[:0], f.buf[end:]...)
+	return err
+}
+
+// Copies everything this session prints on stdout, the -jsonl events included,
+// to w as well
+func (mp *MiniPinger) logTo(w io.Writer) {
+	mp.console = io.MultiWriter(mp.console, w)
+	mp.stdout = mp.roundWriter(mp.console)
+	if !mp.eventSocket {
+		mp.events = json.NewEncoder(mp.console)
+	}
+}
+
+// Appends to a log file and, when a write would take it past max bytes,
+// first moves it to path.1, replacing the one before, and starts a new file.
+// Writes go straight to the file, so there is nothing to flush. A max of 0
+// never rotates.
+type rotatingWriter struct {
+	mu   sync.Mutex
+	path string
+	max  int64
+	file *os.File
+	size int64
+}
+
+func openRotatingWriter(path string, max int64) (*rotatingWriter, error) {
+	w := &rotatingWriter{path: path, max: max}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *rotatingWriter) open() error {
+	file, err := os.OpenFile(w.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	w.file = file
+	w.size = info.Size()
+	return nil
+}
+
+func (w *rotatingWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.max > 0 && w.size > 0 && w.size+int64(len(b)) > w.max {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *rotatingWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(w.path, w.path+".1"); err != nil {
+		return err
+	}
+	return w.open()
+}
+
+func (w *rotatingWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Close()
+}
+
+// Returns w with every line prefixed by the round and the time, or w itself
+// outside of -loop mode
+func (mp *MiniPinger) roundWriter(w io.Writer) io.Writer {
+	if mp.round == 0 {
+		return w
+	}
+	return &prefixWriter{w: w, prefix: func() string {
+		return fmt.Sprintf("[round %d %s] ", mp.round, mp.now().Format(time.RFC3339))
+	}}
+}
+
+// Starts every line written through it with a prefix
+type prefixWriter struct {
+	w       io.Writer
+	prefix  func() string
+	mu      sync.Mutex
+	midLine bool
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var out []byte
+	for rest := b; len(rest) > 0; {
+		if !p.midLine {
+			out = append(out, p.prefix()...)
+		}
+		end := bytes.IndexByte(rest, '\n')
+		if end < 0 {
+			out = append(out, rest...)
+			p.midLine = true
+			break
+		}
+		out = append(out, rest[:end+1]...)
+		rest = rest[end+1:]
+		p.midLine = false
+	}
+	if _, err := p.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Prints an interim summary every -report period until the run stops
+func (mp *MiniPinger) reportLoop() {
+	ticker := time.NewTicker(mp.report)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-mp.finished:
+			return
+		case <-ticker.C:
+			mp.printInterim()
+		}
+	}
+}
+
+// Prints a one line snapshot of the statistics so far without stopping the run
+func (mp *MiniPinger) printInterim() {
+	stats := mp.stats()
+	out := mp.summaryOutput()
+	line := fmt.Sprintf("interim: %d packets transmitted, %d received, %s loss",
+		stats.Sent, stats.Received, formatLoss(stats))
+	if stats.Received > 0 {
+		line += fmt.Sprintf(", rtt min/max/avg %.3f/%.3f/%.3f ms", stats.MinRTT, stats.MaxRTT, stats.AvgRTT)
+	}
+	mp.flushOutput()
+	fmt.Fprintln(out, line)
+	mp.flushOutput()
+}
@@ -0,0 +1,132 @@
+package miniping
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// -report prints an interim summary every period until the run stops
+func TestReport(t *testing.T) {
+	mp := testPinger("192.0.2.1")
+	mp.report = 20 * time.Millisecond
+	// the interim lines go to stderr next to the event lines
+	mp.jsonl = true
+	injectRTTs(mp, 5*time.Millisecond)
+	out := captureStderr(t, func() {
+		done := make(chan struct{})
+		go func() {
+			mp.reportLoop()
+			close(done)
+		}()
+		time.Sleep(110 * time.Millisecond)
+		mp.stop(stopCount)
+		<-done
+	})
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	if len(lines) < 3 || len(lines) > 6 {
+		t.Errorf("%d interim reports in 110ms, want about 5:\n%s", len(lines), out)
+	}
+	want := "interim: 1 packets transmitted, 1 received, 0% loss, rtt min/max/avg 5.000/5.000/5.000 ms"
+	if lines[0] != want {
+		t.Errorf("report %q, want %q", lines[0], want)
+	}
+}
+
+func TestFlushingWriterKeepsLinesWhole(t *testing.T) {
+	var out bytes.Buffer
+	w := newFlushingWriter(&out)
+	var wg sync.WaitGroup
+	for pinger := 0; pinger < 8; pinger++ {
+		wg.Add(1)
+		go func(pinger int) {
+			defer wg.Done()
+			for seq := 0; seq < 2000; seq++ {
+				fmt.Fprintf(w, "64 bytes from 192.0.2.%d: icmp_seq=%d time=20ms ttl=64\n", pinger, seq)
+			}
+		}(pinger)
+	}
+	wg.Wait()
+	w.Flush()
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 8*2000 {
+		t.Fatalf("got %d lines, want %d", len(lines), 8*2000)
+	}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "64 bytes from 192.0.2.") || !strings.HasSuffix(line, " ttl=64") {
+			t.Fatalf("line split by another writer: %q", line)
+		}
+	}
+}
+
+func TestFlushingWriterHoldsPartialLine(t *testing.T) {
+	var out bytes.Buffer
+	w := newFlushingWriter(&out)
+	w.Write([]byte("whole\npart"))
+	w.Flush()
+	if got := out.String(); got != "whole\n" {
+		t.Errorf("flushed %q, want only the whole line", got)
+	}
+	w.Write([]byte(" done\n"))
+	w.Flush()
+	if got := out.String(); got != "whole\npart done\n" {
+		t.Errorf("flushed %q, want the line completed", got)
+	}
+}
+
+// Several pingers printing a reply line each at once, as -flush with several
+// destinations does
+func BenchmarkFlushingWriter(b *testing.B) {
+	w := newFlushingWriter(io.Discard)
+	line := []byte("64 bytes from 192.0.2.1: icmp_seq=1 time=20.123456ms ttl=64\n")
+	b.SetBytes(int64(len(line)))
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			w.Write(line)
+		}
+	})
+	w.Flush()
+}
+
+// The log file moves to .1 before a write would take it past -logmax
+func TestRotatingWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ping.log")
+	if err := os.WriteFile(path, []byte("earlier\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w, err := openRotatingWriter(path, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"line 1\n", "line 2\n", "line 3\n", "line 4\n", "line 5\n"} {
+		if _, err := w.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path, want string
+	}{
+		// the first rotation, of the earlier contents and line 1, was
+		// replaced by the second
+		{path + ".1", "line 2\nline 3\n"},
+		{path, "line 4\nline 5\n"},
+	}
+	for _, tt := range tests {
+		got, err := os.ReadFile(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s holds %q, want %q", filepath.Base(tt.path), got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package miniping
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Writes the ICMP messages sent and received to a pcap file. The sockets only
+// hand over the ICMP part, so each message gets a synthesized IP header and
+// the file uses the raw IP link type.
+type pcapWriter struct {
+	file *os.File
+	ipv6 bool
+	mu   sync.Mutex
+}
+
+// Link type of pcap files whose packets start with an IPv4 or IPv6 header
+const linktypeRaw = 101
+
+// Creates the pcap file at path and writes its global header
+func newPcapWriter(path string, ipv6 bool) (*pcapWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:4], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:6], 2)
+	binary.LittleEndian.PutUint16(header[6:8], 4)
+	binary.LittleEndian.PutUint32(header[16:20], 65535)
+	binary.LittleEndian.PutUint32(header[20:24], linktypeRaw)
+	if _, err := file.Write(header); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &pcapWriter{file: file, ipv6: ipv6}, nil
+}
+
+// Writes an ICMP message as a packet between src and dst; an unknown address
+// (our own, usually) is written as unspecified
+func (w *pcapWriter) writePacket(t time.Time, src net.IP, dst net.IP, ttl int, message []byte) {
+	var packet []byte
+	if w.ipv6 {
+		packet = make([]byte, ipv6.HeaderLen+len(message))
+		packet[0] = 0x60
+		binary.BigEndian.PutUint16(packet[4:6], uint16(len(message)))
+		packet[6] = 58
+		packet[7] = byte(ttl)
+		copy(packet[8:24], src.To16())
+		copy(packet[24:40], dst.To16())
+		copy(packet[ipv6.HeaderLen:], message)
+	} else {
+		packet = make([]byte, ipv4.HeaderLen+len(message))
+		packet[0] = 0x45
+		binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+		packet[8] = byte(ttl)
+		packet[9] = 1
+		copy(packet[12:16], src.To4())
+		copy(packet[16:20], dst.To4())
+		binary.BigEndian.PutUint16(packet[10:12], ipChecksum(packet[:ipv4.HeaderLen]))
+		copy(packet[ipv4.HeaderLen:], message)
+	}
+	record := make([]byte, 16)
+	binary.LittleEndian.PutUint32(record[0:4], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(record[4:8], uint32(t.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:12], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(record[12:16], uint32(len(packet)))
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.file.Write(append(record, packet...))
+}
+
+// Closes the pcap file
+func (w *pcapWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Close()
+}
+
+// Returns the Internet checksum of b
+func ipChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
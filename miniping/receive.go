@@ -0,0 +1,1150 @@
+package miniping
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Number of consecutive transient read errors after which the reader gives up
+// unless -best-effort is set
+const maxReadErrors = 5
+
+// How long each of the last reads after listening is over waits for a reply
+// already queued on the socket. A deadline already past would fail the read
+// before looking at the socket at all.
+const lastReadWait = 10 * time.Millisecond
+
+// How long the last reads after listening is over may take altogether, so a
+// steady stream of replies, or of other traffic the socket sees, can't keep
+// them going
+const lastReadsLimit = 100 * time.Millisecond
+
+// Reports whether an echo reply belongs to this session: the identifier, the
+// token embedded in the payload and the sequence number stamped after it have
+// to match, or only the payload with -no-id-match
+func (mp *MiniPinger) isOwnReply(body *icmp.Echo) bool {
+	if body.ID != mp.id && !mp.noIDMatch {
+		return false
+	}
+	token := mp.payloadToken()
+	if len(body.Data) < len(token) {
+		// a truncated reply can only be checked as far as it goes
+		token = token[:len(body.Data)]
+	}
+	if !bytes.HasPrefix(body.Data, token) {
+		return false
+	}
+	if mp.stampsSeq() && len(body.Data) >= tokenLength+4 {
+		// the header carries only 16 bits of the sequence number
+		return mp.wireSeq(int(binary.BigEndian.Uint32(body.Data[tokenLength:]))) == body.Seq
+	}
+	return true
+}
+
+// Reads a packet like ReadFrom does, but through recvmsg so that the receive
+// timestamp comes along with the TTL and destination control messages
+func (mp *MiniPinger) readTimestamped(conn icmpConn, b []byte) (n int, ttl int, tos int, dst net.IP, src net.Addr, stamp time.Time, source string, err error) {
+	oob := make([]byte, 256)
+	messages := []ipv4.Message{{Buffers: [][]byte{b}, OOB: oob}}
+	isIPv4 := mp.isIPv4
+	if isIPv4 {
+		_, err = conn.IPv4PacketConn().ReadBatch(messages, 0)
+	} else {
+		_, err = conn.IPv6PacketConn().ReadBatch(messages, 0)
+	}
+	if err != nil {
+		return 0, 0, 0, nil, nil, time.Time{}, stampUserspace, err
+	}
+	m := messages[0]
+	oob = oob[:m.NN]
+	if isIPv4 {
+		var controlMessage ipv4.ControlMessage
+		if controlMessage.Parse(oob) == nil {
+			ttl = controlMessage.TTL
+			dst = controlMessage.Dst
+		}
+	} else {
+		var controlMessage ipv6.ControlMessage
+		if controlMessage.Parse(oob) == nil {
+			ttl = controlMessage.HopLimit
+			dst = controlMessage.Dst
+			if mp.tos >= 0 {
+				tos = controlMessage.TrafficClass
+			}
+		}
+	}
+	stamp, source = receiveTimestamp(oob)
+	n = m.N
+	if isIPv4 && !mp.datagram && n >= ipv4.HeaderLen {
+		// unlike ReadFrom, recvmsg on a raw IPv4 socket leaves the IP header
+		// in, which is where -Q reads the reply TOS from
+		if mp.tos >= 0 {
+			tos = int(b[1])
+		}
+		headerLen := int(b[0]&0x0f) << 2
+		if headerLen > n {
+			headerLen = n
+		}
+		n = copy(b, b[headerLen:n])
+	}
+	return n, ttl, tos, dst, m.Addr, stamp, source, nil
+}
+
+// Returns the IP ID in the IPv4 header quoted at the start of an ICMP error
+func quotedIPID(data []byte) (int, bool) {
+	if len(data) < ipv4.HeaderLen || data[0]>>4 != ipv4.Version {
+		return 0, false
+	}
+	return int(binary.BigEndian.Uint16(data[4:6])), true
+}
+
+// Checks the IP ID quoted in an ICMP error about packet seq under -ipid and
+// returns a note for its line, saying whether a router or NAT on the way
+// rewrote the ID
+func (mp *MiniPinger) ipIDNote(seq int, quoted []byte) string {
+	if !mp.ipIDs {
+		return ""
+	}
+	got, ok := quotedIPID(quoted)
+	if !ok {
+		return ""
+	}
+	want := ipIDFor(seq)
+	mp.mu.Lock()
+	mp.ipIDsChecked++
+	if got != want {
+		mp.ipIDsRewritten++
+	}
+	mp.mu.Unlock()
+	if got != want {
+		return fmt.Sprintf(" ip_id rewritten 0x%04x->0x%04x", want, got)
+	}
+	return fmt.Sprintf(" ip_id=0x%04x", got)
+}
+
+// Continuously reads packets off the connection and hands them to the matcher.
+// The read deadline only lets the loop notice shutdown; timeouts are handled by the matcher.
+func (mp *MiniPinger) receivePacket(conn icmpConn, wg *sync.WaitGroup) {
+	defer wg.Done()
+	// the matcher handles replies until there are no more
+	defer close(mp.replies)
+	readErrors := 0
+	// set once listening is over, for the last reads of replies already queued
+	// on the socket
+	lastReads := false
+	var lastReadsUntil time.Time
+	for {
+		if lastReads {
+			deadline := time.Now().Add(lastReadWait)
+			if deadline.After(lastReadsUntil) {
+				deadline = lastReadsUntil
+			}
+			if !time.Now().Before(deadline) {
+				return
+			}
+			conn.SetReadDeadline(deadline)
+		} else {
+			// checked after setting the deadline, so a shutdown can't slip in
+			// between the check and the read and leave it blocked for an interval
+			conn.SetReadDeadline(mp.readDeadline())
+			select {
+			case <-mp.listenDone:
+				lastReads = true
+				lastReadsUntil = time.Now().Add(lastReadsLimit)
+				continue
+			default:
+			}
+		}
+		buffer := make([]byte, mp.receiveBufferSize())
+		var ttl int
+		tos := -1
+		var err error
+		var icmpCode int
+		var numBytes int
+		// bytes that landed in the buffer, to tell whether the reply filled it
+		var readBytes int
+		var src net.Addr
+		// where the reply went to, which is the source address our packets left with
+		var dst net.IP
+		// the kernel's receive time under -hwtime, zero if it didn't give one
+		var stamp time.Time
+		stampSource := stampUserspace
+		if mp.kernelTimestamps {
+			numBytes, ttl, tos, dst, src, stamp, stampSource, err = mp.readTimestamped(conn, buffer)
+			icmpCode = 1
+			if !mp.isIPv4 {
+				icmpCode = 58
+			}
+		} else if mp.isIPv4 && mp.tos >= 0 {
+			var header *ipv4.Header
+			numBytes, header, src, err = readIPv4WithHeader(conn, buffer)
+			if err == nil {
+				ttl = header.TTL
+				tos = header.TOS
+				dst = header.Dst
+				readBytes = numBytes + header.Len
+			}
+			icmpCode = 1
+		} else if mp.isIPv4 {
+			var controlMessage *ipv4.ControlMessage
+			numBytes, controlMessage, src, err = conn.IPv4PacketConn().ReadFrom(buffer)
+			if err == nil && controlMessage != nil {
+				ttl = controlMessage.TTL
+				dst = controlMessage.Dst
+			}
+			icmpCode = 1
+		} else {
+			var controlMessage *ipv6.ControlMessage
+			numBytes, controlMessage, src, err = conn.IPv6PacketConn().ReadFrom(buffer)
+			if err == nil && controlMessage != nil {
+				ttl = controlMessage.HopLimit
+				dst = controlMessage.Dst
+				if mp.tos >= 0 {
+					tos = controlMessage.TrafficClass
+				}
+			}
+			icmpCode = 58
+		}
+		if err != nil {
+			var netErr net.Error
+			if lastReads {
+				// nothing more queued, or nothing more to be had
+				return
+			}
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			readErrors++
+			fatal := isFatalReadError(err)
+			if !mp.bestEffort && (fatal || readErrors >= maxReadErrors) {
+				fmt.Fprintf(os.Stderr, "aborting after read error: %v\n", err)
+				mp.mu.Lock()
+				mp.runErr = classifyError(err)
+				mp.mu.Unlock()
+				mp.stop(stopError)
+				return
+			}
+			fmt.Fprintf(os.Stderr, "read error: %v\n", err)
+			if fatal {
+				// a broken socket fails every read at once, don't spin on it
+				select {
+				case <-mp.listenDone:
+					return
+				case <-time.After(mp.interval):
+				}
+			}
+			continue
+		}
+		readErrors = 0
+		receivedAt := mp.now()
+		if !stamp.IsZero() {
+			receivedAt = stamp
+		}
+		if mp.kernelTimestamps {
+			mp.mu.Lock()
+			mp.stampSources[stampSource]++
+			mp.mu.Unlock()
+		}
+		if readBytes == 0 {
+			readBytes = numBytes
+		}
+		truncated := readBytes == len(buffer)
+		if icmpCode == 58 {
+			numBytes = copy(buffer, icmpv6Message(buffer[:numBytes]))
+		}
+		if mp.pcap != nil {
+			var srcIP net.IP
+			if ipAddr, ok := src.(*net.IPAddr); ok {
+				srcIP = ipAddr.IP
+			}
+			mp.pcap.writePacket(receivedAt, srcIP, nil, ttl, buffer[:numBytes])
+		}
+		rm, err := icmp.ParseMessage(icmpCode, buffer[:numBytes])
+		if err != nil {
+			if mp.errorOutput() {
+				fmt.Fprintln(mp.stdout, "Error parsing message")
+			}
+			if mp.verbose {
+				fmt.Fprintln(os.Stderr, parseDiagnostic(err, buffer[:numBytes], icmpCode, src))
+			}
+			continue
+		}
+		mp.replies <- &reply{message: rm, numBytes: numBytes, ttl: ttl, tos: tos, receivedAt: receivedAt,
+			truncated: truncated, src: src, dst: dst}
+	}
+}
+
+// IPv6 extension headers that may sit between the IPv6 header and the
+// ICMPv6 message: hop-by-hop options, routing, fragment and destination options
+var ipv6ExtensionHeaders = map[int]bool{0: true, 43: true, 44: true, 60: true}
+
+// Returns the ICMPv6 message in b. Raw ICMPv6 sockets hand over just the
+// message, but should b start with an IPv6 header after all, the header and
+// any extension headers in front of the message are skipped. No ICMPv6 type
+// starts with the nibble 6 (types 96 to 111 are unassigned), so the version
+// field tells the two apart.
+func icmpv6Message(b []byte) []byte {
+	if len(b) < ipv6.HeaderLen || b[0]>>4 != 6 {
+		return b
+	}
+	next := int(b[6])
+	rest := b[ipv6.HeaderLen:]
+	for next != 58 {
+		if !ipv6ExtensionHeaders[next] || len(rest) < 8 {
+			return b
+		}
+		// the fragment header is always 8 bytes, the others give their length
+		// in 8 byte units, not counting the first 8
+		length := 8
+		if next != 44 {
+			length = (int(rest[1]) + 1) * 8
+		}
+		if len(rest) < length {
+			return b
+		}
+		next = int(rest[0])
+		rest = rest[length:]
+	}
+	return rest
+}
+
+// Number of leading bytes of an unparsable message dumped under -v
+const diagnosticBytes = 32
+
+// Describes a message that failed to parse: the error, the size and sender,
+// the protocol it was parsed as and its first bytes in hex
+func parseDiagnostic(err error, message []byte, protocol int, src net.Addr) string {
+	dump := message
+	if len(dump) > diagnosticBytes {
+		dump = dump[:diagnosticBytes]
+	}
+	return fmt.Sprintf("  %v: %d bytes from %v parsed as protocol %d, first %d bytes: % x",
+		err, len(message), src, protocol, len(dump), dump)
+}
+
+// Reports whether a read error means the socket itself is gone, as opposed to a
+// transient failure such as a full buffer or an interrupted call
+func isFatalReadError(err error) bool {
+	return errors.Is(err, net.ErrClosed) || errors.Is(err, syscall.EBADF) ||
+		errors.Is(err, syscall.ENOTSOCK) || errors.Is(err, syscall.EINVAL)
+}
+
+// Returns when the next read gives up: a per-packet timeout from now, but never
+// past the overall deadline, so the reader doesn't sit out a last read once the
+// run is over
+func (mp *MiniPinger) readDeadline() time.Time {
+	deadline := time.Now().Add(mp.perPacketTimeout)
+	mp.mu.Lock()
+	startTime := mp.startTime
+	mp.mu.Unlock()
+	if startTime.IsZero() {
+		return deadline
+	}
+	// once past the end, as during a -drain, only the per-packet timeout is left
+	endTime := startTime.Add(mp.totalDeadline)
+	if endTime.Before(deadline) && endTime.After(time.Now()) {
+		return endTime
+	}
+	return deadline
+}
+
+// Returns the size of the buffer replies are read into. Unless set with
+// -bufsize it leaves room for the echoed payload plus a full IPv4 header with
+// options, the ICMP header, and the headers an ICMP error quotes.
+func (mp *MiniPinger) receiveBufferSize() int {
+	if mp.bufferSize > 0 {
+		return mp.bufferSize
+	}
+	return mp.packetSize + 2*60 + 2*8
+}
+
+// Reads an IPv4 packet together with its header, since the x/net control
+// messages don't carry the TOS byte, and moves the ICMP message to the start of b
+func readIPv4WithHeader(conn icmpConn, b []byte) (int, *ipv4.Header, net.Addr, error) {
+	ipConn, ok := conn.IPv4PacketConn().PacketConn.(*net.IPConn)
+	if !ok {
+		return 0, nil, nil, errors.New("reading the reply TOS needs a raw socket")
+	}
+	n, _, _, src, err := ipConn.ReadMsgIP(b, nil)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	header, err := ipv4.ParseHeader(b[:n])
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	copy(b, b[header.Len:n])
+	return n - header.Len, header, src, nil
+}
+
+// Correlates replies with sent packets and reports packets whose timer expired
+func (mp *MiniPinger) matchReplies(wg *sync.WaitGroup) {
+	defer wg.Done()
+	finished := mp.finished
+	for {
+		select {
+		case <-finished:
+			mp.mu.Lock()
+			for _, timer := range mp.timers {
+				timer.Stop()
+			}
+			mp.mu.Unlock()
+			// a nil channel never fires; replies are still taken during a -drain
+			// and from the receiver's last reads
+			finished = nil
+		case seq := <-mp.timeouts:
+			if finished == nil {
+				continue
+			}
+			mp.mu.Lock()
+			_, pending := mp.timeSent[seq]
+			delete(mp.timers, seq)
+			if pending {
+				mp.settle(seq, statusTimeout)
+			}
+			// a later packet was answered already, so this one went missing
+			gap := mp.showGaps && seq < mp.latestReplied
+			mp.mu.Unlock()
+			if !pending {
+				continue
+			}
+			mp.notifyTimeout(seq)
+			mp.observe(seq, false)
+			if mp.jsonl {
+				mp.emit(event{Type: "timeout", Time: mp.now(), Seq: seq})
+			} else if mp.errorOutput() {
+				fmt.Fprintln(mp.stdout, "Request timed out.")
+			}
+			if gap {
+				mp.printGaps([]int{seq})
+			}
+		case r, ok := <-mp.replies:
+			if !ok {
+				return
+			}
+			mp.handleReply(r)
+		}
+	}
+}
+
+// Matches an ICMP port unreachable against the UDP probe it quotes, by the
+// ports of the quoted UDP header. Routers and hosts only have to quote the IP
+// header and 8 bytes beyond it, so the token and sequence number in the
+// payload are used when they came back, and otherwise the reply goes to the
+// oldest probe still waiting.
+func (mp *MiniPinger) handleUDPReply(r *reply) {
+	messageBody, ok := r.message.Body.(*icmp.DstUnreach)
+	if !ok {
+		return
+	}
+	if !(r.message.Type == ipv4.ICMPTypeDestinationUnreachable && r.message.Code == 3) &&
+		!(r.message.Type == ipv6.ICMPTypeDestinationUnreachable && r.message.Code == 4) {
+		return
+	}
+	datagram := quotedUDP(messageBody.Data, mp.isIPv4)
+	if datagram == nil || int(binary.BigEndian.Uint16(datagram[0:2])) != mp.udpSourcePort ||
+		int(binary.BigEndian.Uint16(datagram[2:4])) != mp.udpPort {
+		return
+	}
+	var packetNumber int
+	if payload := datagram[8:]; len(payload) >= tokenLength+4 {
+		if !bytes.Equal(payload[:tokenLength], mp.token) {
+			return
+		}
+		packetNumber = int(binary.BigEndian.Uint32(payload[tokenLength:]))
+	} else if packetNumber, ok = mp.oldestPending(); !ok {
+		return
+	}
+	travelTime, ok := mp.recordReply(packetNumber, r)
+	if !ok {
+		return
+	}
+	mp.noteRouterError(r)
+	previousTTL := mp.trackTTL(r.ttl)
+	mp.observe(packetNumber, true)
+	if mp.jsonl {
+		mp.emit(event{Type: "reply", Time: r.receivedAt, Seq: packetNumber, Bytes: r.numBytes,
+			TTL: r.ttl, RTT: float64(travelTime) / float64(time.Millisecond), RouteChanged: previousTTL != 0,
+			Hops: mp.hopsEstimate(r.ttl)})
+		return
+	}
+	if !mp.perPacketOutput() {
+		return
+	}
+	fmt.Fprintf(mp.stdout, "port %d unreachable from %s: seq=%d time=%v ttl=%v%s%s%s \n",
+		mp.udpPort, mp.destination(), packetNumber, travelTime, r.ttl, mp.hopsNote(r.ttl), mp.timesNote(packetNumber, r.receivedAt),
+		routeNote(previousTTL, r.ttl))
+}
+
+// Returns the sequence number of the oldest packet still waiting for an answer
+func (mp *MiniPinger) oldestPending() (int, bool) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	for _, record := range mp.packets {
+		if record.Status == statusPending {
+			return record.Seq, true
+		}
+	}
+	return 0, false
+}
+
+// Reports a parameter problem raised by a router or the destination against
+// one of our echo requests; the packet counts as failed rather than timed out
+func (mp *MiniPinger) handleParamProb(r *reply, body *icmp.ParamProb) {
+	seq, ok := mp.quotedEchoSeq(body.Data)
+	if !ok || !mp.recordFailure(seq) {
+		return
+	}
+	mp.noteRouterError(r)
+	ipIDNote := mp.ipIDNote(seq, body.Data)
+	mp.observe(seq, false)
+	if mp.jsonl {
+		mp.emit(event{Type: "error", Time: r.receivedAt, Seq: seq, TTL: r.ttl})
+		return
+	}
+	if !mp.perPacketOutput() {
+		return
+	}
+	fmt.Fprintf(mp.stdout, "From %v icmp_seq=%d Parameter problem: pointer %d%s\n", r.src, seq, body.Pointer, ipIDNote)
+}
+
+// Reports the hop that dropped a -ttl-sweep packet whose TTL ran out on the way
+func (mp *MiniPinger) handleTimeExceeded(r *reply, body *icmp.TimeExceeded) {
+	seq, ok := mp.quotedEchoSeq(body.Data)
+	if !ok {
+		return
+	}
+	travelTime, ok := mp.recordHop(seq, r)
+	if !ok {
+		return
+	}
+	mp.noteRouterError(r)
+	ipIDNote := mp.ipIDNote(seq, body.Data)
+	if mp.jsonl {
+		mp.emit(event{Type: statusExceeded, Time: r.receivedAt, Seq: seq, TTL: r.ttl,
+			RTT: float64(travelTime) / float64(time.Millisecond)})
+		return
+	}
+	if !mp.perPacketOutput() {
+		return
+	}
+	fmt.Fprintf(mp.stdout, "From %s icmp_seq=%d ttl=%d Time to live exceeded time=%v%s\n", mp.hopName(r.src.String()), seq, mp.ttlFor(seq), travelTime, ipIDNote)
+}
+
+// Reports whether address, which may carry a %zone, is link-local. Those
+// addresses have no meaningful names in the DNS.
+func isLinkLocal(address string) bool {
+	if i := strings.IndexByte(address, '%'); i >= 0 {
+		address = address[:i]
+	}
+	ip := net.ParseIP(address)
+	return ip != nil && ip.IsLinkLocalUnicast()
+}
+
+// How long the -ttl-sweep summary waits for hop names still being looked up
+const hopNameWait = 2 * time.Second
+
+// Returns the name a hop's address resolves back to together with the address,
+// or just the address with -n, without a name, or while the name is still
+// being looked up. Names are looked up once per address, in the background so
+// a slow resolver never holds up matching replies; routers balancing load
+// answer the same probes over and over.
+func (mp *MiniPinger) hopName(address string) string {
+	if mp.numeric || mp.lookupName == nil || isLinkLocal(address) {
+		return address
+	}
+	mp.mu.Lock()
+	name := mp.hopNames[address]
+	if _, started := mp.hopLookups[address]; !started {
+		done := make(chan struct{})
+		mp.hopLookups[address] = done
+		go func() {
+			found := mp.lookupName(address)
+			mp.mu.Lock()
+			mp.hopNames[address] = found
+			mp.mu.Unlock()
+			close(done)
+		}()
+	}
+	mp.mu.Unlock()
+	if name == "" {
+		return address
+	}
+	return fmt.Sprintf("%s (%s)", name, address)
+}
+
+// Starts looking up the names of addresses and waits, until deadline at the
+// latest, for every lookup started so far to finish
+func (mp *MiniPinger) awaitHopNames(addresses []string, deadline time.Time) {
+	for _, address := range addresses {
+		mp.hopName(address)
+	}
+	mp.mu.Lock()
+	pending := make([]chan struct{}, 0, len(mp.hopLookups))
+	for _, done := range mp.hopLookups {
+		pending = append(pending, done)
+	}
+	mp.mu.Unlock()
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	for _, done := range pending {
+		select {
+		case <-done:
+		case <-timer.C:
+			return
+		}
+	}
+}
+
+// Marks seq as dropped by the hop that sent r and returns the time it took to
+// hear back, or false if seq wasn't outstanding
+func (mp *MiniPinger) recordHop(seq int, r *reply) (time.Duration, bool) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	sentAt, pending := mp.timeSent[seq]
+	if !pending {
+		return 0, false
+	}
+	delete(mp.timeSent, seq)
+	if timer, ok := mp.timers[seq]; ok {
+		timer.Stop()
+		delete(mp.timers, seq)
+	}
+	travelTime := r.receivedAt.Sub(sentAt)
+	if record := mp.record(seq); record != nil {
+		record.RTT = travelTime
+		record.From = r.src.String()
+	}
+	mp.settle(seq, statusExceeded)
+	return travelTime, true
+}
+
+// Marks seq as answered by an ICMP error and reports whether it was outstanding
+func (mp *MiniPinger) recordFailure(seq int) bool {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	if _, pending := mp.timeSent[seq]; !pending {
+		return false
+	}
+	delete(mp.timeSent, seq)
+	if timer, ok := mp.timers[seq]; ok {
+		timer.Stop()
+		delete(mp.timers, seq)
+	}
+	mp.settle(seq, statusError)
+	return true
+}
+
+// Returns the sequence number of our echo request quoted in an ICMP error, or
+// false if the quoted packet isn't one of ours
+func (mp *MiniPinger) quotedEchoSeq(data []byte) (int, bool) {
+	var headerLength int
+	var echoType byte
+	if mp.isIPv4 {
+		if len(data) < ipv4.HeaderLen || data[9] != 1 {
+			return 0, false
+		}
+		headerLength = int(data[0]&0x0f) * 4
+		echoType = byte(ipv4.ICMPTypeEcho)
+	} else {
+		if len(data) < ipv6.HeaderLen || data[6] != 58 {
+			return 0, false
+		}
+		headerLength = ipv6.HeaderLen
+		echoType = byte(ipv6.ICMPTypeEchoRequest)
+	}
+	if len(data) < headerLength+8 {
+		return 0, false
+	}
+	echo := data[headerLength:]
+	if echo[0] != echoType || (int(binary.BigEndian.Uint16(echo[4:6])) != mp.id && !mp.noIDMatch) {
+		return 0, false
+	}
+	// the token can only be checked when enough of the payload was quoted
+	if quoted := echo[8:]; len(quoted) >= len(mp.payloadToken()) && !bytes.HasPrefix(quoted, mp.payloadToken()) {
+		return 0, false
+	}
+	seq := mp.unwrapSeq(int(binary.BigEndian.Uint16(echo[6:8])))
+	return seq, seq >= 0
+}
+
+// Returns the UDP header and payload quoted in an ICMP error, or nil if the
+// quoted packet isn't UDP
+func quotedUDP(data []byte, isIPv4 bool) []byte {
+	var headerLength int
+	if isIPv4 {
+		if len(data) < ipv4.HeaderLen || data[9] != syscall.IPPROTO_UDP {
+			return nil
+		}
+		headerLength = int(data[0]&0x0f) * 4
+	} else {
+		if len(data) < ipv6.HeaderLen || data[6] != syscall.IPPROTO_UDP {
+			return nil
+		}
+		headerLength = ipv6.HeaderLen
+	}
+	if len(data) < headerLength+8 {
+		return nil
+	}
+	return data[headerLength:]
+}
+
+// Processes a single packet read off the connection
+func (mp *MiniPinger) handleReply(r *reply) {
+	if mp.udpPort != 0 {
+		mp.handleUDPReply(r)
+		return
+	}
+	if body, ok := r.message.Body.(*icmp.ParamProb); ok {
+		mp.handleParamProb(r, body)
+		return
+	}
+	if body, ok := r.message.Body.(*icmp.TimeExceeded); ok && mp.sweepTo > 0 {
+		mp.handleTimeExceeded(r, body)
+		return
+	}
+	if r.message.Type == ipv4.ICMPTypeTimestampReply && mp.timestamp {
+		mp.handleTimestampReply(r)
+		return
+	}
+	if r.message.Type != ipv4.ICMPTypeEchoReply && r.message.Type != ipv6.ICMPTypeEchoReply {
+		return
+	}
+	messageBody, ok := r.message.Body.(*icmp.Echo)
+	if !ok || !mp.isOwnReply(messageBody) {
+		return
+	}
+	packetNumber := mp.unwrapSeq(messageBody.Seq)
+	if !mp.acceptSource(packetNumber, r) {
+		return
+	}
+	travelTime, ok := mp.recordReply(packetNumber, r)
+	if !ok {
+		return
+	}
+	if r.truncated {
+		fmt.Fprintf(os.Stderr, "warning: reply icmp_seq=%d filled the %d byte receive buffer and may be truncated, "+
+			"raise -bufsize\n", packetNumber, mp.receiveBufferSize())
+	}
+	previousTTL := mp.trackTTL(r.ttl)
+	expectNote := mp.checkExpectedTTL(r.ttl)
+	tosNote := mp.checkTOS(r.tos)
+	shortNote := mp.checkReplySize(len(messageBody.Data))
+	corruptNote := mp.checkPattern(messageBody.Data)
+	mp.observe(packetNumber, true)
+	if mp.jsonl {
+		mp.emit(event{Type: "reply", Time: r.receivedAt, Seq: packetNumber, Bytes: r.numBytes,
+			TTL: r.ttl, RTT: float64(travelTime) / float64(time.Millisecond), RouteChanged: previousTTL != 0,
+			Hops: mp.hopsEstimate(r.ttl)})
+		return
+	}
+	if !mp.perPacketOutput() {
+		return
+	}
+	from := mp.destination().String()
+	responderNote := ""
+	if responder := mp.otherResponder(r); responder != "" {
+		responderNote = fmt.Sprintf(" (sent to %s)", from)
+		from = responder
+	}
+	if mp.format != nil {
+		mp.printFormatted(replyFields{Seq: packetNumber, Bytes: r.numBytes, From: from,
+			TTL: r.ttl, RTT: travelTime})
+		return
+	}
+	fmt.Fprintf(mp.stdout, "%d bytes from %s: icmp_seq=%d time=%v ttl=%v%s%s%s%s%s%s%s%s%s \n",
+		r.numBytes, from, packetNumber, travelTime, r.ttl, mp.hopsNote(r.ttl), responderNote, mp.srcNote(r),
+		mp.timesNote(packetNumber, r.receivedAt), tosNote, shortNote, corruptNote, routeNote(previousTTL, r.ttl), expectNote)
+}
+
+// Formats the -hops estimate of the hops a reply with this TTL took
+func (mp *MiniPinger) hopsNote(ttl int) string {
+	hops := mp.hopsEstimate(ttl)
+	if hops == nil {
+		return ""
+	}
+	return fmt.Sprintf(" hops≈%d", *hops)
+}
+
+// Returns the -hops estimate of the hops a reply with this TTL took, or nil
+// without -hops or a TTL
+func (mp *MiniPinger) hopsEstimate(ttl int) *int {
+	if !mp.showHops || ttl == 0 {
+		return nil
+	}
+	_, hops := inferHops(ttl)
+	return &hops
+}
+
+// Reports whether an ICMP timestamp is a standard one, milliseconds since
+// midnight UTC. RFC 792 has hosts without such a clock set the high-order bit,
+// and hosts that don't implement timestamps at all leave them zero.
+func standardTimestamp(ms int64) bool {
+	return ms > 0 && ms&0x80000000 == 0 && ms < 24*60*60*1000
+}
+
+// Estimates the offset of the destination's clock from ours, NTP style as the
+// mean of the offsets seen on the way there and on the way back, and the
+// one-way delay as half of the round trip less the time the destination held
+// on to the request
+func timestampOffset(originate, receive, transmit, arrival int64) (offset time.Duration, oneWay time.Duration) {
+	offset = time.Duration((receive-originate)+(transmit-arrival)) * time.Millisecond / 2
+	oneWay = time.Duration((arrival-originate)-(transmit-receive)) * time.Millisecond / 2
+	return offset, oneWay
+}
+
+// Matches a -ts Timestamp Reply and reports its timestamps along with the
+// estimated clock offset and one-way delay. A destination that doesn't fill in
+// standard timestamps only yields the RTT.
+func (mp *MiniPinger) handleTimestampReply(r *reply) {
+	body, ok := r.message.Body.(*icmp.RawBody)
+	if !ok || len(body.Data) < 16 {
+		return
+	}
+	if int(binary.BigEndian.Uint16(body.Data[0:2])) != mp.id && !mp.noIDMatch {
+		return
+	}
+	packetNumber := mp.unwrapSeq(int(binary.BigEndian.Uint16(body.Data[2:4])))
+	if !mp.acceptSource(packetNumber, r) {
+		return
+	}
+	originate := int64(binary.BigEndian.Uint32(body.Data[4:8]))
+	receive := int64(binary.BigEndian.Uint32(body.Data[8:12]))
+	transmit := int64(binary.BigEndian.Uint32(body.Data[12:16]))
+	arrival := int64(msSinceMidnight(r.receivedAt))
+	travelTime, ok := mp.recordReply(packetNumber, r)
+	if !ok {
+		return
+	}
+	usable := standardTimestamp(receive) && standardTimestamp(transmit)
+	offset, oneWay := timestampOffset(originate, receive, transmit, arrival)
+	mp.mu.Lock()
+	if record := mp.record(packetNumber); record != nil && usable {
+		record.Offset = offset
+		record.OneWay = oneWay
+	} else if record != nil {
+		record.NoTimestamps = true
+	}
+	mp.mu.Unlock()
+	mp.observe(packetNumber, true)
+	if mp.jsonl {
+		mp.emit(event{Type: "reply", Time: r.receivedAt, Seq: packetNumber, Bytes: r.numBytes,
+			TTL: r.ttl, RTT: float64(travelTime) / float64(time.Millisecond), Hops: mp.hopsEstimate(r.ttl)})
+		return
+	}
+	if !mp.perPacketOutput() {
+		return
+	}
+	if !usable {
+		fmt.Fprintf(mp.stdout, "%d bytes from %s: icmp_seq=%d time=%v%s (no standard timestamps: receive=%#x transmit=%#x)\n",
+			r.numBytes, mp.destination(), packetNumber, travelTime, mp.hopsNote(r.ttl), receive, transmit)
+		return
+	}
+	fmt.Fprintf(mp.stdout, "%d bytes from %s: icmp_seq=%d time=%v%s originate=%d receive=%d transmit=%d offset=%v one-way=%v\n",
+		r.numBytes, mp.destination(), packetNumber, travelTime, mp.hopsNote(r.ttl), originate, receive, transmit, offset, oneWay)
+}
+
+// Returns a note for a reply that echoed back less payload than was sent, which
+// points at truncation on the path (e.g. MTU trouble) rather than loss
+func (mp *MiniPinger) checkReplySize(size int) string {
+	if size >= mp.packetSize {
+		return ""
+	}
+	mp.mu.Lock()
+	mp.shortReplies++
+	mp.mu.Unlock()
+	return fmt.Sprintf(" (truncated: got %d want %d)", size, mp.packetSize)
+}
+
+// Returns the -times note for a reply: the monotonic send time relative to the
+// start of the run next to the wall clock time the reply was received at, so an
+// RTT that disagrees with the wall clock points at a clock step
+func (mp *MiniPinger) timesNote(seq int, receivedAt time.Time) string {
+	if !mp.showTimes {
+		return ""
+	}
+	var sentAt time.Time
+	mp.mu.Lock()
+	if record := mp.record(seq); record != nil {
+		sentAt = record.SentAt
+	}
+	mp.mu.Unlock()
+	return fmt.Sprintf(" sent=+%v received=%s", sentAt.Sub(mp.startTime),
+		receivedAt.Round(0).Format("15:04:05.000000"))
+}
+
+// Compares the TOS of a reply with the one sent and returns the note for the
+// reply line. The ECN bits (the low two) are reported separately from DSCP
+// because ECN-aware paths are expected to change them.
+func (mp *MiniPinger) checkTOS(tos int) string {
+	if mp.tos < 0 || tos < 0 {
+		return ""
+	}
+	note := fmt.Sprintf(" tos=0x%02x", tos)
+	if tos == mp.tos {
+		return note
+	}
+	mp.mu.Lock()
+	mp.tosRemarked++
+	mp.mu.Unlock()
+	if tos>>2 != mp.tos>>2 {
+		note += fmt.Sprintf(" (dscp remarked: %d->%d)", mp.tos>>2, tos>>2)
+	}
+	if tos&0x3 != mp.tos&0x3 {
+		note += fmt.Sprintf(" (ecn remarked: %02b->%02b)", mp.tos&0x3, tos&0x3)
+	}
+	return note
+}
+
+// Remembers the TTL of a reply and returns the previous one if it differs, or
+// zero if it didn't change. A changing TTL usually means the route changed or
+// replies are load balanced over paths of different length.
+func (mp *MiniPinger) trackTTL(ttl int) int {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	if ttl == 0 {
+		return 0
+	}
+	previous := mp.lastTTL
+	mp.lastTTL = ttl
+	if previous == 0 || previous == ttl {
+		return 0
+	}
+	mp.ttlChanges++
+	return previous
+}
+
+// Returns the local address the echo request left from, as seen from the
+// reply coming back to it, for -show-src
+func (mp *MiniPinger) srcNote(r *reply) string {
+	if !mp.showSrc || r.dst == nil {
+		return ""
+	}
+	if r.dst.To4() == nil && r.dst.IsLinkLocalUnicast() {
+		// a link-local source only means something on the destination's link
+		return fmt.Sprintf(" src=%v", &net.IPAddr{IP: r.dst, Zone: mp.destination().Zone})
+	}
+	return fmt.Sprintf(" src=%v", r.dst)
+}
+
+// Initial TTLs common operating systems send packets with
+var commonInitialTTLs = []int{32, 64, 128, 255}
+
+// Infers the TTL a reply started out with, the smallest common initial TTL not
+// below the observed one, and how many hops it took to get here. That is the
+// length of the path back from the destination, which under asymmetric
+// routing can differ from the path there, and a host sending with an
+// uncommon initial TTL throws the estimate off altogether.
+func inferHops(ttl int) (int, int) {
+	for _, initial := range commonInitialTTLs {
+		if ttl <= initial {
+			return initial, initial - ttl
+		}
+	}
+	return ttl, 0
+}
+
+// Tallies the inferred initial TTL of a reply for -expect-ttl and returns a
+// note if its TTL isn't the expected one, along with the hop counts both imply.
+// A different initial TTL points at another OS answering, a different hop
+// count at a longer or shorter path.
+func (mp *MiniPinger) checkExpectedTTL(ttl int) string {
+	if mp.expectTTL == 0 || ttl == 0 {
+		return ""
+	}
+	initial, hops := inferHops(ttl)
+	mp.mu.Lock()
+	mp.initialTTLs[initial]++
+	mp.mu.Unlock()
+	if ttl == mp.expectTTL {
+		return ""
+	}
+	expectedInitial, expectedHops := inferHops(mp.expectTTL)
+	return fmt.Sprintf(" (expected ttl %d, %d hops from %d; got %d hops from %d)",
+		mp.expectTTL, expectedHops, expectedInitial, hops, initial)
+}
+
+// Formats the note appended to a reply whose TTL differs from the previous reply
+func routeNote(previousTTL int, ttl int) string {
+	if previousTTL == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (route changed: ttl %d->%d)", previousTTL, ttl)
+}
+
+// Marks seq as answered by r and returns its round trip time, or false if seq isn't outstanding
+func (mp *MiniPinger) recordReply(seq int, r *reply) (time.Duration, bool) {
+	responder := mp.otherResponder(r)
+	from := responder
+	if from == "" {
+		from = mp.destination().String()
+	}
+	// printed once the lock is released, ahead of the line for this reply
+	var gaps []int
+	defer func() {
+		mp.printGaps(gaps)
+	}()
+	// handed to OnReply once the lock is released
+	var result *PacketResult
+	defer func() {
+		if result != nil {
+			mp.notifyReply(*result)
+		}
+	}()
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	sentAt, pending := mp.timeSent[seq]
+	if !pending {
+		if record := mp.record(seq); record != nil && record.Status == statusReplied {
+			mp.duplicates++
+		}
+		return 0, false
+	}
+	// a late reply is still counted, even if its timer already fired
+	delete(mp.timeSent, seq)
+	if timer, ok := mp.timers[seq]; ok {
+		timer.Stop()
+		delete(mp.timers, seq)
+	}
+	travelTime := r.receivedAt.Sub(sentAt)
+	record := mp.record(seq)
+	if record != nil {
+		record.RTT = travelTime
+		record.TTL = r.ttl
+		record.From = responder
+	}
+	if seq < mp.latestReplied {
+		if record != nil {
+			record.OutOfOrder = true
+		}
+		mp.reordered++
+	} else {
+		if mp.showGaps {
+			// packets skipped over that already timed out; those still
+			// pending are reported when their timer fires
+			for skipped := mp.latestReplied + 1; skipped < seq; skipped++ {
+				if record := mp.record(skipped); record != nil && record.Status == statusTimeout {
+					gaps = append(gaps, skipped)
+				}
+			}
+		}
+		mp.latestReplied = seq
+	}
+	mp.settle(seq, statusReplied)
+	mp.packetsReceived++
+	mp.bytesReceived += int64(r.numBytes)
+	if mp.drain > 0 {
+		select {
+		case <-mp.finished:
+			mp.drainedReplies++
+		default:
+		}
+	}
+	result = &PacketResult{Seq: seq, From: from, Bytes: r.numBytes, TTL: r.ttl, RTT: travelTime, ReceivedAt: r.receivedAt}
+	return travelTime, true
+}
+
+// Reports packets that -gaps found missing: timed out while a later packet
+// was answered
+func (mp *MiniPinger) printGaps(seqs []int) {
+	for _, seq := range seqs {
+		if mp.jsonl {
+			mp.emit(event{Type: "gap", Time: mp.now(), Seq: seq})
+		} else if mp.perPacketOutput() {
+			fmt.Fprintf(mp.stdout, "gap: missing seq %d\n", seq)
+		}
+	}
+}
+
+// Returns the address a reply came from, with the zone of a link-local IPv6
+// one, or nil if it can't be told
+func sourceAddress(src net.Addr) *net.IPAddr {
+	switch address := src.(type) {
+	case *net.IPAddr:
+		return address
+	case *net.UDPAddr:
+		return &net.IPAddr{IP: address.IP, Zone: address.Zone}
+	}
+	return nil
+}
+
+// Returns the address that sent r if it isn't the destination, as happens
+// with anycast, or an empty string
+func (mp *MiniPinger) otherResponder(r *reply) string {
+	source := sourceAddress(r.src)
+	if source == nil || source.IP.Equal(mp.destination().IP) {
+		return ""
+	}
+	return source.String()
+}
+
+// Reports whether the reply r to packet seq may be accepted: always, unless
+// -validate-reply-source is on and it came from another address than the
+// destination and the -reply-sources. A rejected reply is counted and noted,
+// and the packet stays unanswered. ICMP errors, which routers send, don't come
+// through here.
+func (mp *MiniPinger) acceptSource(seq int, r *reply) bool {
+	if !mp.validateSource {
+		return true
+	}
+	source := sourceAddress(r.src)
+	if mp.expectedSource(source) {
+		return true
+	}
+	mp.mu.Lock()
+	mp.rejectedSources++
+	mp.mu.Unlock()
+	from := "an unknown address"
+	if source != nil {
+		from = source.String()
+	}
+	// kept off stdout, where a reply line for seq could be taken for an answer
+	if mp.jsonl {
+		mp.emit(event{Type: "rejected", Time: r.receivedAt, Seq: seq, Bytes: r.numBytes})
+	} else if mp.errorOutput() {
+		fmt.Fprintf(os.Stderr, "rejected reply icmp_seq=%d from %s: not the destination %s\n",
+			seq, from, mp.destination())
+	}
+	return false
+}
+
+// Reports whether source is the destination or one of the -reply-sources
+func (mp *MiniPinger) expectedSource(source *net.IPAddr) bool {
+	if source == nil {
+		return false
+	}
+	if source.IP.Equal(mp.destination().IP) {
+		return true
+	}
+	for _, allowed := range mp.replySources {
+		if source.IP.Equal(allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// Counts an ICMP error matched to one of our packets that came from another
+// address than the destination under -validate-reply-source. Routers send
+// those, so they can't be held to the destination's address, but the summary
+// tells them apart from the validated replies.
+func (mp *MiniPinger) noteRouterError(r *reply) {
+	if !mp.validateSource || mp.expectedSource(sourceAddress(r.src)) {
+		return
+	}
+	mp.mu.Lock()
+	mp.routerErrors++
+	mp.mu.Unlock()
+}
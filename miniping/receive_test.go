@@ -0,0 +1,896 @@
+package miniping
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// A reply only counts if both the identifier and the token at the start of
+// the payload are this session's
+func TestIsOwnReply(t *testing.T) {
+	mp := testPinger("192.0.2.1")
+	own := make([]byte, mp.packetSize)
+	copy(own, mp.token)
+	foreign := make([]byte, mp.packetSize)
+	copy(foreign, mp.token)
+	foreign[0] ^= 0xff
+	tests := []struct {
+		name string
+		id   int
+		data []byte
+		want bool
+	}{
+		{"own", mp.id, own, true},
+		{"right ID, wrong token", mp.id, foreign, false},
+		{"wrong ID, right token", mp.id + 1, own, false},
+		{"token cut short", mp.id, own[:4], true},
+		{"wrong token cut short", mp.id, foreign[:4], false},
+	}
+	for _, tt := range tests {
+		if got := mp.isOwnReply(&icmp.Echo{ID: tt.id, Seq: 0, Data: tt.data}); got != tt.want {
+			t.Errorf("%s: own reply %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// Replies whose TTL differs from the one before are counted as route changes
+// and noted on their line
+func TestTrackTTL(t *testing.T) {
+	mp := testPinger("192.0.2.1")
+	tests := []struct {
+		ttl      int
+		previous int
+		note     string
+	}{
+		{57, 0, ""},
+		{57, 0, ""},
+		{55, 57, " (route changed: ttl 57->55)"},
+		// a reply without a TTL leaves the last one alone
+		{0, 0, ""},
+		{57, 55, " (route changed: ttl 55->57)"},
+	}
+	for i, tt := range tests {
+		previous := mp.trackTTL(tt.ttl)
+		if previous != tt.previous {
+			t.Errorf("reply %d, ttl %d: previous ttl %d, want %d", i, tt.ttl, previous, tt.previous)
+		}
+		if note := routeNote(previous, tt.ttl); note != tt.note {
+			t.Errorf("reply %d, ttl %d: note %q, want %q", i, tt.ttl, note, tt.note)
+		}
+	}
+	if mp.ttlChanges != 2 {
+		t.Errorf("%d ttl changes, want 2", mp.ttlChanges)
+	}
+}
+
+// The TOS read back from a reply is compared with the one sent, DSCP and ECN
+// apart
+func TestCheckTOS(t *testing.T) {
+	tests := []struct {
+		sent     int
+		read     int
+		note     string
+		remarked int
+	}{
+		{-1, 0x2e, "", 0},
+		{0xb8, -1, "", 0},
+		{0xb8, 0xb8, " tos=0xb8", 0},
+		{0xb9, 0xbb, " tos=0xbb (ecn remarked: 01->11)", 1},
+		{0xb8, 0x00, " tos=0x00 (dscp remarked: 46->0)", 1},
+		{0xba, 0x01, " tos=0x01 (dscp remarked: 46->0) (ecn remarked: 10->01)", 1},
+	}
+	for _, tt := range tests {
+		mp := testPinger("192.0.2.1")
+		mp.tos = tt.sent
+		if note := mp.checkTOS(tt.read); note != tt.note {
+			t.Errorf("tos 0x%02x read back as 0x%02x: note %q, want %q", tt.sent, tt.read, note, tt.note)
+		}
+		if mp.tosRemarked != tt.remarked {
+			t.Errorf("tos 0x%02x read back as 0x%02x: %d remarked, want %d", tt.sent, tt.read, mp.tosRemarked, tt.remarked)
+		}
+	}
+}
+
+// -times shows when a packet was sent by the pinger's clock, relative to the
+// start, and the wall clock time its reply came in
+func TestTimesNote(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	now := start
+	mp := testPinger("192.0.2.1")
+	mp.now = func() time.Time {
+		return now
+	}
+	mp.startTime = start
+	now = start.Add(1500 * time.Millisecond)
+	mp.markSent(0)
+	receivedAt := now.Add(20 * time.Millisecond)
+	if note := mp.timesNote(0, receivedAt); note != "" {
+		t.Errorf("note %q without -times", note)
+	}
+	mp.showTimes = true
+	if note, want := mp.timesNote(0, receivedAt), " sent=+1.5s received=12:00:01.520000"; note != want {
+		t.Errorf("note %q, want %q", note, want)
+	}
+}
+
+// A reply that fills the receive buffer to the last byte may have been cut
+// off, which gets a warning
+func TestTruncatedReply(t *testing.T) {
+	tests := []struct {
+		name string
+		// bytes of echo data short of filling the buffer
+		short     int
+		truncated bool
+	}{
+		{"fills the buffer", 0, true},
+		{"fits", 1, false},
+	}
+	for _, tt := range tests {
+		mp := testPinger("127.0.0.1")
+		mp.bufferSize = 64
+		conn := newFakeConn(t)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go mp.receivePacket(conn, &wg)
+		mp.markSent(0)
+		data := make([]byte, mp.bufferSize-8-tt.short)
+		copy(data, mp.payload)
+		conn.deliver(t, &icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &icmp.Echo{ID: mp.id, Seq: 0, Data: data}})
+		var r *reply
+		select {
+		case r = <-mp.replies:
+		case <-time.After(time.Second):
+			t.Fatalf("%s: the reply wasn't read", tt.name)
+		}
+		mp.stop(stopCount)
+		wg.Wait()
+		if r.truncated != tt.truncated {
+			t.Errorf("%s: truncated %v, want %v", tt.name, r.truncated, tt.truncated)
+		}
+		warning := captureStderr(t, func() {
+			mp.handleReply(r)
+		})
+		if warned := strings.Contains(warning, "may be truncated"); warned != tt.truncated {
+			t.Errorf("%s: warning %q", tt.name, warning)
+		}
+	}
+}
+
+// A read waits for the per-packet timeout, but never past the overall
+// deadline, so the reader is done when the run is
+func TestReadDeadline(t *testing.T) {
+	const timeout = time.Second
+	tests := []struct {
+		name string
+		// how long ago the run started, if it did
+		started  time.Duration
+		deadline time.Duration
+		// how far off the read deadline should be
+		want time.Duration
+	}{
+		{"not started", 0, 10 * time.Second, timeout},
+		{"deadline far off", 2 * time.Second, 10 * time.Second, timeout},
+		{"deadline within the timeout", 9700 * time.Millisecond, 10 * time.Second, 300 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		mp := testPinger("192.0.2.1")
+		mp.perPacketTimeout = timeout
+		mp.totalDeadline = tt.deadline
+		now := time.Now()
+		if tt.started > 0 {
+			mp.startTime = now.Add(-tt.started)
+		}
+		got := mp.readDeadline().Sub(now)
+		// the time readDeadline took itself
+		if got < tt.want || got > tt.want+100*time.Millisecond {
+			t.Errorf("%s: read deadline %v from now, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// The reader blocked in a read returns as soon as the run is over and the read
+// deadline pulled in, as run does after the last send, not an interval later
+func TestReceiveReturnsOnStop(t *testing.T) {
+	mp := testPinger("127.0.0.1")
+	mp.interval = 10 * time.Second
+	conn := newFakeConn(t)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go mp.receivePacket(conn, &wg)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	// let it block in the read
+	time.Sleep(20 * time.Millisecond)
+	start := time.Now()
+	mp.stop(stopCount)
+	conn.SetReadDeadline(time.Now())
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the reader still runs a second after the stop")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("the reader returned %v after the stop", elapsed)
+	}
+}
+
+// Returns our echo request seq as an ICMP error quotes it: the IPv4 header,
+// then the request with as much of its payload as quoted
+func quotedEcho(t *testing.T, mp *MiniPinger, seq int) []byte {
+	request := icmp.Message{Type: ipv4.ICMPTypeEcho, Body: &icmp.Echo{ID: mp.id, Seq: seq, Data: mp.payload}}
+	b, err := request.Marshal(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := make([]byte, ipv4.HeaderLen)
+	header[0] = 0x45
+	header[8] = 64
+	header[9] = 1
+	copy(header[12:16], net.IPv4(198, 51, 100, 1).To4())
+	copy(header[16:20], mp.ipAddress.IP.To4())
+	return append(header, b...)
+}
+
+// A parameter problem quoting one of our requests fails that packet: it is
+// counted as an error and doesn't time out
+func TestParamProb(t *testing.T) {
+	mp := testPinger("192.0.2.1")
+	mp.markSent(0)
+	mp.markSent(1)
+	problem := icmp.Message{Type: ipv4.ICMPTypeParameterProblem, Body: &icmp.ParamProb{Pointer: 20, Data: quotedEcho(t, mp, 1)}}
+	b, err := problem.Marshal(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := icmp.ParseMessage(1, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp.handleReply(&reply{message: m, numBytes: len(b), src: &net.IPAddr{IP: net.ParseIP("198.51.100.1")}, receivedAt: time.Now()})
+	stats := mp.stats()
+	if stats.Errors != 1 || stats.Received != 0 {
+		t.Errorf("%d errors and %d replies, want the one error", stats.Errors, stats.Received)
+	}
+	if status := stats.Packets[1].Status; status != statusError {
+		t.Errorf("packet 1 %s, want %s", status, statusError)
+	}
+	if status := stats.Packets[0].Status; status != statusPending {
+		t.Errorf("packet 0 %s, want still %s", status, statusPending)
+	}
+	if _, ok := mp.timers[1]; ok {
+		t.Error("packet 1 can still time out")
+	}
+}
+
+// With -no-id-match a reply whose identifier a middlebox rewrote still
+// answers its request, by sequence number and token
+func TestNoIDMatch(t *testing.T) {
+	for _, noIDMatch := range []bool{false, true} {
+		mp := testPinger("192.0.2.1")
+		mp.noIDMatch = noIDMatch
+		mp.markSent(0)
+		m := &icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &icmp.Echo{ID: mp.id + 1, Seq: 0, Data: mp.payload}}
+		mp.handleReply(&reply{message: m, numBytes: 64, ttl: 64, receivedAt: time.Now()})
+		if answered := mp.stats().Received == 1; answered != noIDMatch {
+			t.Errorf("-no-id-match %v: rewritten identifier accepted %v", noIDMatch, answered)
+		}
+	}
+}
+
+// A link-local target needs a zone, which is asked for before anything is sent
+func TestLinkLocalNeedsZone(t *testing.T) {
+	_, err := NewMiniPinger("fe80::1", Options{Count: 1, TTL: 64, Interval: time.Second, PacketSize: 56, Deadline: time.Second})
+	if err == nil || !strings.Contains(err.Error(), "needs a zone") {
+		t.Errorf("fe80::1: %v, want a zone asked for", err)
+	}
+	if _, err := NewMiniPinger("fe80::1%lo", Options{Count: 1, TTL: 64, Interval: time.Second, PacketSize: 56, Deadline: time.Second}); err != nil {
+		t.Errorf("fe80::1%%lo: %v", err)
+	}
+}
+
+// A reply echoing back less than the payload sent counts as answered, but is
+// flagged and counted apart
+func TestShortReply(t *testing.T) {
+	mp := testPinger("192.0.2.1")
+	mp.markSent(0)
+	mp.markSent(1)
+	for seq, size := range []int{mp.packetSize, 20} {
+		m := &icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &icmp.Echo{ID: mp.id, Seq: seq, Data: echoData(mp, seq)[:size]}}
+		mp.handleReply(&reply{message: m, numBytes: 8 + size, ttl: 64, receivedAt: time.Now()})
+	}
+	stats := mp.stats()
+	if stats.Received != 2 || stats.ShortReplies != 1 {
+		t.Errorf("%d replies, %d short, want 2 and 1", stats.Received, stats.ShortReplies)
+	}
+	if note, want := mp.checkReplySize(20), " (truncated: got 20 want 56)"; note != want {
+		t.Errorf("note %q, want %q", note, want)
+	}
+	if note := mp.checkReplySize(56); note != "" {
+		t.Errorf("note %q for a whole reply", note)
+	}
+}
+
+func TestParseDiagnostic(t *testing.T) {
+	message := make([]byte, 40)
+	for i := range message {
+		message[i] = byte(i)
+	}
+	src := &net.IPAddr{IP: net.ParseIP("192.0.2.9")}
+	got := parseDiagnostic(errors.New("message too short"), message, 1, src)
+	want := "  message too short: 40 bytes from 192.0.2.9 parsed as protocol 1, first 32 bytes: 00 01 02 03"
+	if !strings.HasPrefix(got, want) || !strings.HasSuffix(got, " 1e 1f") {
+		t.Errorf("got %q", got)
+	}
+	got = parseDiagnostic(errors.New("message too short"), message[:2], 58, src)
+	if !strings.HasSuffix(got, "parsed as protocol 58, first 2 bytes: 00 01") {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestInferHops(t *testing.T) {
+	tests := []struct {
+		ttl     int
+		initial int
+		hops    int
+	}{
+		{64, 64, 0},
+		{57, 64, 7},
+		{1, 32, 31},
+		{33, 64, 31},
+		{120, 128, 8},
+		{200, 255, 55},
+		{255, 255, 0},
+	}
+	for _, tt := range tests {
+		if initial, hops := inferHops(tt.ttl); initial != tt.initial || hops != tt.hops {
+			t.Errorf("ttl %d: initial ttl %d and %d hops, want %d and %d", tt.ttl, initial, hops, tt.initial, tt.hops)
+		}
+	}
+}
+
+func TestExpectTTL(t *testing.T) {
+	mp := testPinger("192.0.2.1")
+	mp.expectTTL = 57
+	for _, ttl := range []int{57, 57, 120} {
+		mp.checkExpectedTTL(ttl)
+	}
+	if got, want := mp.checkExpectedTTL(60), " (expected ttl 57, 7 hops from 64; got 4 hops from 64)"; got != want {
+		t.Errorf("note %q, want %q", got, want)
+	}
+	if got := mp.checkExpectedTTL(57); got != "" {
+		t.Errorf("note %q for the expected ttl", got)
+	}
+	var out strings.Builder
+	mp.printInitialTTLs(&out)
+	if got, want := out.String(), "inferred initial ttl: 64 (4 replies), 128 (1 replies)\n"; got != want {
+		t.Errorf("summary %q, want %q", got, want)
+	}
+}
+
+// With -no-id-match a rewritten identifier is fine, but the payload has to
+// carry the session token and the sequence number of the reply
+func TestPayloadMatch(t *testing.T) {
+	mp := testPinger("192.0.2.1")
+	mp.noIDMatch = true
+	foreign := echoData(mp, 7)
+	foreign[0] ^= 0xff
+	tests := []struct {
+		name string
+		seq  int
+		data []byte
+		want bool
+	}{
+		{"right token", 7, echoData(mp, 7), true},
+		{"wrong token", 7, foreign, false},
+		{"other sequence number", 7, echoData(mp, 8), false},
+		{"sequence number past 16 bits", 7, echoData(mp, 0x10007), true},
+	}
+	for _, tt := range tests {
+		if got := mp.isOwnReply(&icmp.Echo{ID: mp.id ^ 0x5555, Seq: tt.seq, Data: tt.data}); got != tt.want {
+			t.Errorf("%s: own reply %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// -show-src reports the local address the replies come back to
+func TestShowSrc(t *testing.T) {
+	mp := testPinger("127.0.0.1")
+	mp.showSrc = true
+	conn := newFakeConn(t)
+	// as run asks for with -show-src
+	if err := conn.IPv4PacketConn().SetControlMessage(ipv4.FlagDst, true); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go mp.receivePacket(conn, &wg)
+	mp.markSent(0)
+	conn.deliver(t, &icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &icmp.Echo{ID: mp.id, Seq: 0, Data: echoData(mp, 0)}})
+	var r *reply
+	select {
+	case r = <-mp.replies:
+	case <-time.After(time.Second):
+		t.Fatal("the reply wasn't read")
+	}
+	mp.stop(stopCount)
+	wg.Wait()
+	if got, want := mp.srcNote(r), " src=127.0.0.1"; got != want {
+		t.Errorf("note %q, want %q", got, want)
+	}
+	mp.showSrc = false
+	if got := mp.srcNote(r); got != "" {
+		t.Errorf("note %q without -show-src", got)
+	}
+}
+
+// An ICMPv6 message behind an IPv6 header and a hop-by-hop options header is
+// found and parsed; one on its own is left as it is
+func TestICMPv6Message(t *testing.T) {
+	echo := icmp.Message{Type: ipv6.ICMPTypeEchoReply, Body: &icmp.Echo{ID: 0x1234, Seq: 7, Data: []byte("payload!")}}
+	message, err := echo.Marshal(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := make([]byte, ipv6.HeaderLen)
+	header[0] = 6 << 4
+	// hop-by-hop options next
+	header[6] = 0
+	hopByHop := []byte{58, 0, 1, 4, 0, 0, 0, 0}
+	packet := append(append(header, hopByHop...), message...)
+	for name, b := range map[string][]byte{"with headers": packet, "message only": message} {
+		m, err := icmp.ParseMessage(58, icmpv6Message(b))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		body, ok := m.Body.(*icmp.Echo)
+		if m.Type != ipv6.ICMPTypeEchoReply || !ok || body.ID != 0x1234 || body.Seq != 7 || string(body.Data) != "payload!" {
+			t.Errorf("%s: parsed %v %+v", name, m.Type, m.Body)
+		}
+	}
+}
+
+func TestHopNames(t *testing.T) {
+	names := map[string]string{"192.0.2.1": "gw.example", "198.51.100.1": "core.example"}
+	tests := []struct {
+		address string
+		numeric bool
+		want    string
+	}{
+		{"192.0.2.1", false, "gw.example (192.0.2.1)"},
+		{"198.51.100.1", false, "core.example (198.51.100.1)"},
+		{"203.0.113.1", false, "203.0.113.1"},
+		{"fe80::1%eth0", false, "fe80::1%eth0"},
+		{"192.0.2.1", true, "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		mp := testPinger("192.0.2.1")
+		mp.numeric = tt.numeric
+		var mu sync.Mutex
+		lookups := make(map[string]int)
+		mp.lookupName = func(address string) string {
+			mu.Lock()
+			defer mu.Unlock()
+			lookups[address]++
+			return names[address]
+		}
+		// as ECMP paths answer from the same router more than once
+		mp.awaitHopNames([]string{tt.address, tt.address}, time.Now().Add(time.Second))
+		if got := mp.hopName(tt.address); got != tt.want {
+			t.Errorf("%s: hop %q, want %q", tt.address, got, tt.want)
+		}
+		mu.Lock()
+		if lookups[tt.address] > 1 {
+			t.Errorf("%s: looked up %d times", tt.address, lookups[tt.address])
+		}
+		mu.Unlock()
+	}
+}
+
+// A name lookup that hangs doesn't hold up the trace past the deadline
+func TestSlowHopName(t *testing.T) {
+	mp := testPinger("192.0.2.1")
+	stalled := make(chan struct{})
+	defer close(stalled)
+	mp.lookupName = func(address string) string {
+		<-stalled
+		return "slow.example"
+	}
+	start := time.Now()
+	if got := mp.hopName("192.0.2.1"); got != "192.0.2.1" {
+		t.Errorf("hop %q before the lookup finished, want the address", got)
+	}
+	mp.awaitHopNames([]string{"192.0.2.1"}, time.Now().Add(50*time.Millisecond))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("waited %v for the name, want 50ms", elapsed)
+	}
+}
+
+// Past 65535 packets a reply matches the latest packet with its 16-bit
+// sequence number, with the RTT of that packet
+func TestSeqWrapRTT(t *testing.T) {
+	mp := testPinger("192.0.2.1")
+	mp.stdout = io.Discard
+	// no timers for the 70000 packets
+	mp.fireAndForget = true
+	base := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	var now time.Time
+	mp.now = func() time.Time {
+		return now
+	}
+	const sent = 70000
+	for seq := 0; seq < sent; seq++ {
+		now = base.Add(time.Duration(seq) * time.Millisecond)
+		mp.markSent(seq)
+	}
+	if len(mp.timeSent) != 0x10000 {
+		t.Errorf("%d packets awaiting a reply, want the latest 65536", len(mp.timeSent))
+	}
+	// 3 and 65539 share their sequence number on the wire
+	for _, seq := range []int{65539, sent - 1} {
+		mp.handleReply(&reply{message: &icmp.Message{Type: ipv4.ICMPTypeEchoReply,
+			Body: &icmp.Echo{ID: mp.id, Seq: mp.wireSeq(seq), Data: echoData(mp, seq)}},
+			receivedAt: base.Add(time.Duration(seq)*time.Millisecond + 5*time.Millisecond)})
+	}
+	stats := mp.stats()
+	for _, seq := range []int{65539, sent - 1} {
+		if record := stats.Packets[seq]; record.Status != statusReplied || record.RTT != 5*time.Millisecond {
+			t.Errorf("packet %d: %s after %v, want replied after 5ms", seq, record.Status, record.RTT)
+		}
+	}
+	if stats.Packets[3].Status != statusPending || stats.Received != 2 {
+		t.Errorf("packet 3 %s, %d replies, want pending and 2", stats.Packets[3].Status, stats.Received)
+	}
+}
+
+// Returns a timestamp reply to packet seq of mp with the destination's receive
+// and transmit timestamps
+func timestampReply(mp *MiniPinger, seq int, originate, receive, transmit int64) *icmp.Message {
+	b := timestampRequest(mp.id, mp.wireSeq(seq), time.Time{})
+	binary.BigEndian.PutUint32(b[4:8], uint32(originate))
+	binary.BigEndian.PutUint32(b[8:12], uint32(receive))
+	binary.BigEndian.PutUint32(b[12:16], uint32(transmit))
+	return &icmp.Message{Type: ipv4.ICMPTypeTimestampReply, Body: &icmp.RawBody{Data: b}}
+}
+
+// A destination whose clock is 100ms ahead, 10ms away each way and holding on
+// to the request for 1ms, and one that fills in no timestamps
+func TestTimestampOffset(t *testing.T) {
+	mp := testPinger("192.0.2.1")
+	mp.stdout = io.Discard
+	mp.timestamp = true
+	noon := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	mp.now = func() time.Time {
+		return noon
+	}
+	originate := int64(msSinceMidnight(noon))
+	mp.markSent(0)
+	mp.markSent(1)
+	mp.handleReply(&reply{message: timestampReply(mp, 0, originate, originate+110, originate+111),
+		receivedAt: noon.Add(21 * time.Millisecond)})
+	mp.handleReply(&reply{message: timestampReply(mp, 1, originate, 0, 0),
+		receivedAt: noon.Add(21 * time.Millisecond)})
+	mp.stop(stopCount)
+	stats := mp.stats()
+	if record := stats.Packets[0]; record.Offset != 100*time.Millisecond || record.OneWay != 10*time.Millisecond {
+		t.Errorf("offset %v, one-way %v, want 100ms and 10ms", record.Offset, record.OneWay)
+	}
+	if !stats.Packets[1].NoTimestamps || stats.Received != 2 {
+		t.Errorf("no timestamps %v with %d replies, want true and 2", stats.Packets[1].NoTimestamps, stats.Received)
+	}
+	var out strings.Builder
+	printClockOffsets(&out, stats)
+	want := "clock offset min/avg/max: 100ms/100ms/100ms\none-way delay min/avg/max: 10ms/10ms/10ms\n"
+	if out.String() != want {
+		t.Errorf("summary %q, want %q", out.String(), want)
+	}
+}
+
+// A reply overtaken by the one to a later packet counts as received, but with
+// -exclude-reordered its RTT stays out of the statistics
+func TestExcludeReordered(t *testing.T) {
+	for _, exclude := range []bool{false, true} {
+		mp := testPinger("192.0.2.1")
+		mp.stdout = io.Discard
+		mp.excludeReordered = exclude
+		base := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+		mp.now = func() time.Time {
+			return base
+		}
+		mp.markSent(0)
+		mp.markSent(1)
+		for _, answer := range []struct {
+			seq int
+			rtt time.Duration
+		}{{1, 5 * time.Millisecond}, {0, 50 * time.Millisecond}} {
+			mp.handleReply(&reply{message: &icmp.Message{Type: ipv4.ICMPTypeEchoReply,
+				Body: &icmp.Echo{ID: mp.id, Seq: answer.seq, Data: echoData(mp, answer.seq)}}, receivedAt: base.Add(answer.rtt)})
+		}
+		mp.stop(stopCount)
+		stats := mp.stats()
+		if stats.Received != 2 || stats.Reordered != 1 {
+			t.Errorf("exclude %v: %d replies, %d reordered, want 2 and 1", exclude, stats.Received, stats.Reordered)
+		}
+		wantMax := 50.0
+		if exclude {
+			wantMax = 5
+		}
+		if stats.MinRTT != 5 || stats.MaxRTT != wantMax {
+			t.Errorf("exclude %v: rtt min/max %v/%v, want 5/%v", exclude, stats.MinRTT, stats.MaxRTT, wantMax)
+		}
+	}
+}
+
+// A reply already queued on the socket when the run stops is still read and
+// counted
+func TestReplyQueuedAtShutdown(t *testing.T) {
+	mp := testPinger("127.0.0.1")
+	mp.stdout = io.Discard
+	conn := newFakeConn(t)
+	mp.markSent(0)
+	conn.deliver(t, echoReply(mp, 0))
+	mp.stop(stopCount)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go mp.receivePacket(conn, &wg)
+	go mp.matchReplies(&wg)
+	wg.Wait()
+	if stats := mp.stats(); stats.Received != 1 {
+		t.Errorf("%d replies, want the queued one", stats.Received)
+	}
+}
+
+// With -redundancy 2 each packet goes out twice; one copy answered is no
+// loss, and the reply to the second copy is an expected duplicate
+func TestRedundancy(t *testing.T) {
+	mp := testPinger("192.0.2.1")
+	mp.stdout = io.Discard
+	mp.redundancy = 2
+	conn := newFakeConn(t)
+	for i := 0; i < 2; i++ {
+		if err := mp.sendPacket(conn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(conn.ttls) != 4 {
+		t.Errorf("%d copies sent, want 4", len(conn.ttls))
+	}
+	// one copy of packet 0 lost, both of packet 1 answered
+	for _, seq := range []int{0, 1, 1} {
+		mp.handleReply(&reply{message: echoReply(mp, seq), receivedAt: time.Now()})
+	}
+	mp.stop(stopCount)
+	stats := mp.stats()
+	if stats.Sent != 2 || stats.Received != 2 || stats.Duplicates != 1 || stats.Loss != 0 {
+		t.Errorf("%d sent, %d received, %d duplicates, %d%% loss, want 2, 2, 1 and 0%%",
+			stats.Sent, stats.Received, stats.Duplicates, stats.Loss)
+	}
+	if stats.BytesSent != 4*64 {
+		t.Errorf("%d bytes sent, want %d", stats.BytesSent, 4*64)
+	}
+}
+
+// A link-local destination keeps its zone wherever it is shown, and its
+// addresses are never looked up in the DNS
+func TestLinkLocalZone(t *testing.T) {
+	mp := testPinger("fe80::1%lo")
+	mp.showSrc = true
+	lookups := 0
+	mp.lookupName = func(address string) string {
+		lookups++
+		return "router.example"
+	}
+	if got := mp.destination().String(); got != "fe80::1%lo" {
+		t.Errorf("destination %s, want fe80::1%%lo", got)
+	}
+	mp.awaitHopNames([]string{"fe80::2%lo"}, time.Now().Add(time.Second))
+	if got := mp.hopName("fe80::2%lo"); got != "fe80::2%lo" || lookups != 0 {
+		t.Errorf("hop %q after %d lookups, want the address and none", got, lookups)
+	}
+	if got := mp.srcNote(&reply{dst: net.ParseIP("fe80::5")}); got != " src=fe80::5%lo" {
+		t.Errorf("note %q, want the source with the zone", got)
+	}
+}
+
+// A packet lost between two answered ones is reported once, whether the reply
+// to the next one comes before or after it times out
+func TestGaps(t *testing.T) {
+	tests := []struct {
+		name  string
+		delay time.Duration
+	}{
+		{"next answered before the timeout", 5 * time.Millisecond},
+		{"next answered after the timeout", 60 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		mp := testPinger("127.0.0.1")
+		mp.count = 3
+		mp.interval = 50 * time.Millisecond
+		mp.perPacketTimeout = 80 * time.Millisecond
+		mp.showGaps = true
+		var out bytes.Buffer
+		mp.stdout = &out
+		conn := newFakeConn(t)
+		conn.up["127.0.0.1"] = true
+		conn.delay = tt.delay
+		useConn(mp, &droppingConn{fakeConn: conn, drop: 1})
+		if err := mp.Run(); err != nil {
+			t.Fatal(err)
+		}
+		if n := strings.Count(out.String(), "gap: missing seq"); n != 1 || !strings.Contains(out.String(), "gap: missing seq 1\n") {
+			t.Errorf("%s: %d gap lines in\n%s\nwant one for seq 1", tt.name, n, out.String())
+		}
+		if stats := mp.Stats(); stats.Received != 2 {
+			t.Errorf("%s: %d replies, want 2", tt.name, stats.Received)
+		}
+	}
+}
+
+// The IP ID quoted back in an ICMP error is checked against the one packet
+// seq went out with
+func TestIPIDNote(t *testing.T) {
+	// the header of packet seq as a router quotes it, with its ID
+	quoted := func(id int) []byte {
+		h := &ipv4.Header{Version: ipv4.Version, Len: ipv4.HeaderLen, TotalLen: ipv4.HeaderLen + 64, ID: id,
+			TTL: 1, Protocol: 1, Src: net.IPv4(192, 0, 2, 9), Dst: net.IPv4(192, 0, 2, 1)}
+		b, err := h.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return append(b, make([]byte, 8)...)
+	}
+	mp := testPinger("192.0.2.1")
+	mp.ipIDs = true
+	tests := []struct {
+		seq    int
+		quoted []byte
+		want   string
+	}{
+		{0, quoted(ipIDFor(0)), " ip_id=0x0001"},
+		{7, quoted(0xbeef), " ip_id rewritten 0x0008->0xbeef"},
+		{0xffff, quoted(1), " ip_id=0x0001"},
+		{3, []byte{0x60, 0, 0, 0}, ""},
+	}
+	for _, tt := range tests {
+		if got := mp.ipIDNote(tt.seq, tt.quoted); got != tt.want {
+			t.Errorf("seq %d: note %q, want %q", tt.seq, got, tt.want)
+		}
+	}
+	if stats := mp.stats(); stats.IPIDsChecked != 3 || stats.IPIDsRewritten != 1 {
+		t.Errorf("%d of %d IDs rewritten, want 1 of 3", stats.IPIDsRewritten, stats.IPIDsChecked)
+	}
+	mp.ipIDs = false
+	if got := mp.ipIDNote(0, quoted(0xbeef)); got != "" {
+		t.Errorf("note %q without -ipid", got)
+	}
+}
+
+// Replies to an IPv6 anycast destination from other addresses name the
+// address that answered, scope included, and are counted under it
+func TestOtherResponder(t *testing.T) {
+	mp := testPinger("2001:db8::1")
+	mp.count = 3
+	var out bytes.Buffer
+	mp.stdout = &out
+	sources := []*net.IPAddr{
+		{IP: net.ParseIP("fe80::53"), Zone: "eth0"},
+		{IP: net.ParseIP("2001:db8::1")},
+		{IP: net.ParseIP("2001:db8::53")},
+	}
+	for seq, src := range sources {
+		mp.markSent(seq)
+		mp.handleReply(&reply{message: &icmp.Message{Type: ipv6.ICMPTypeEchoReply,
+			Body: &icmp.Echo{ID: mp.id, Seq: mp.wireSeq(seq), Data: echoData(mp, seq)}},
+			numBytes: 8 + mp.packetSize, ttl: 64, src: src, receivedAt: time.Now()})
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	want := []string{
+		"64 bytes from fe80::53%eth0: icmp_seq=0 ",
+		"64 bytes from 2001:db8::1: icmp_seq=1 ",
+		"64 bytes from 2001:db8::53: icmp_seq=2 ",
+	}
+	for i, line := range lines {
+		if i >= len(want) || !strings.HasPrefix(line, want[i]) {
+			t.Fatalf("printed\n%s\nwant lines starting\n%s", out.String(), strings.Join(want, "\n"))
+		}
+		if sent := strings.Contains(line, "(sent to 2001:db8::1)"); sent != (i != 1) {
+			t.Errorf("line %q", line)
+		}
+	}
+	stats := mp.stats()
+	if len(stats.Responders) != 3 {
+		t.Fatalf("responders %+v, want 3", stats.Responders)
+	}
+	for i, address := range []string{"2001:db8::1", "2001:db8::53", "fe80::53%eth0"} {
+		if r := stats.Responders[i]; r.Address != address || r.Replies != 1 {
+			t.Errorf("responder %d: %+v, want one reply from %s", i, r, address)
+		}
+	}
+}
+
+// Replies to an echo coming from other addresses than the destination, as a
+// spoofed one would, under -validate-reply-source
+func TestValidateReplySource(t *testing.T) {
+	tests := []struct {
+		name     string
+		src      net.Addr
+		accepted bool
+	}{
+		{"destination", &net.IPAddr{IP: net.ParseIP("192.0.2.1")}, true},
+		{"destination on a datagram socket", &net.UDPAddr{IP: net.ParseIP("192.0.2.1")}, true},
+		{"listed reply source", &net.IPAddr{IP: net.ParseIP("192.0.2.9")}, true},
+		{"spoofed", &net.IPAddr{IP: net.ParseIP("198.51.100.7")}, false},
+		{"unknown source", nil, false},
+	}
+	for _, tt := range tests {
+		mp := testPinger("192.0.2.1")
+		mp.validateSource = true
+		mp.replySources = []net.IP{net.ParseIP("192.0.2.9")}
+		mp.markSent(0)
+		mp.handleReply(&reply{message: echoReply(mp, 0), ttl: 64, receivedAt: mp.now(), src: tt.src})
+		stats := mp.stats()
+		if answered := stats.Received == 1; answered != tt.accepted {
+			t.Errorf("%s: reply accepted %v, want %v", tt.name, answered, tt.accepted)
+		}
+		if rejected := stats.RejectedSources == 1; rejected == tt.accepted {
+			t.Errorf("%s: %d replies rejected", tt.name, stats.RejectedSources)
+		}
+	}
+}
+
+// ICMP errors can only come from routers, so they are accepted from anywhere
+// but counted apart under -validate-reply-source
+func TestRouterErrors(t *testing.T) {
+	tests := []struct {
+		validate bool
+		src      string
+		want     int
+	}{
+		{true, "198.51.100.1", 1},
+		{true, "192.0.2.1", 0},
+		{false, "198.51.100.1", 0},
+	}
+	for _, tt := range tests {
+		mp := testPinger("192.0.2.1")
+		mp.validateSource = tt.validate
+		mp.noteRouterError(&reply{src: &net.IPAddr{IP: net.ParseIP(tt.src)}})
+		if got := mp.stats().RouterErrors; got != tt.want {
+			t.Errorf("validate %v, error from %s: %d router errors, want %d", tt.validate, tt.src, got, tt.want)
+		}
+	}
+}
+
+// -hops notes the hops the reply TTL implies, from the next common initial TTL
+func TestHopsEstimate(t *testing.T) {
+	tests := []struct {
+		showHops bool
+		ttl      int
+		want     string
+	}{
+		{false, 57, ""},
+		{true, 0, ""},
+		{true, 57, " hops≈7"},
+		{true, 64, " hops≈0"},
+	}
+	for _, tt := range tests {
+		mp := testPinger("192.0.2.1")
+		mp.showHops = tt.showHops
+		if got := mp.hopsNote(tt.ttl); got != tt.want {
+			t.Errorf("-hops %v, ttl %d: note %q, want %q", tt.showHops, tt.ttl, got, tt.want)
+		}
+	}
+}
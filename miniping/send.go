@@ -0,0 +1,519 @@
+package miniping
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	mathrand "math/rand"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Attempts at a send failing with ENOBUFS, and the backoff that grows by this
+// much after each attempt
+const (
+	enobufsAttempts = 3
+	enobufsBackoff  = 5 * time.Millisecond
+)
+
+// Records seq as sent and starts the timer that reports it as timed out
+func (mp *MiniPinger) markSent(seq int) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	mp.packetsSent++
+	// the packet 65536 before this one went out with the same 16-bit sequence
+	// number, so a late reply to it can't be told apart from one to this one
+	// any more; replies only ever match the latest
+	delete(mp.timeSent, seq-0x10000)
+	mp.timeSent[seq] = mp.now()
+	mp.addRecord(PacketRecord{Seq: seq, SentAt: mp.timeSent[seq], Status: statusPending})
+	mp.outstanding++
+	mp.signalProgress()
+	if mp.fireAndForget {
+		return
+	}
+	mp.timers[seq] = time.AfterFunc(mp.perPacketTimeout, func() {
+		select {
+		case mp.timeouts <- seq:
+		case <-mp.finished:
+		}
+	})
+}
+
+// Adds a packet that went out to the bytes sent, which -bytes stops at
+func (mp *MiniPinger) countBytesSent(n int) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	mp.bytesSent += int64(n)
+	mp.signalProgress()
+}
+
+// Takes back markSent for the last packet, whose send failed before it left.
+// Only its own record goes; addRecord folds before adding, so marking it sent
+// folded nothing that wasn't due anyway.
+func (mp *MiniPinger) unmarkSent(seq int) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	mp.packetsSent--
+	delete(mp.timeSent, seq)
+	if timer, ok := mp.timers[seq]; ok {
+		timer.Stop()
+		delete(mp.timers, seq)
+	}
+	if i := seq - mp.packetBase; i >= 0 && i == len(mp.packets)-1 {
+		mp.packets = mp.packets[:i]
+	}
+	mp.outstanding--
+}
+
+// Reports a failed send, and aborts the run once the destination has been
+// unreachable for -unreachable-after sends in a row rather than reporting
+// 100% loss at the end
+func (mp *MiniPinger) checkSend(err error) {
+	if err == nil {
+		mp.unreachableSends = 0
+		return
+	}
+	fmt.Fprintf(os.Stderr, "send error: %v%s\n", err, mp.sendErrorHint(err))
+	if !errors.Is(err, syscall.ENETUNREACH) && !errors.Is(err, syscall.EHOSTUNREACH) {
+		mp.unreachableSends = 0
+		return
+	}
+	mp.unreachableSends++
+	if mp.unreachableAfter > 0 && mp.unreachableSends >= mp.unreachableAfter {
+		fmt.Fprintf(os.Stderr, "aborting: %s is unreachable from this host\n", mp.destination())
+		mp.mu.Lock()
+		mp.runErr = classifyError(err)
+		mp.mu.Unlock()
+		mp.stop(stopError)
+	}
+}
+
+// Returns guidance for IPv6 send errors whose cause isn't obvious from the error itself
+func (mp *MiniPinger) sendErrorHint(err error) string {
+	if mp.isIPv4 {
+		return ""
+	}
+	destination := mp.destination()
+	linkLocal := destination.IP.IsLinkLocalUnicast()
+	unreachable := errors.Is(err, syscall.ENETUNREACH) || errors.Is(err, syscall.EHOSTUNREACH)
+	switch {
+	case errors.Is(err, syscall.EDESTADDRREQ) || (errors.Is(err, syscall.EINVAL) && linkLocal):
+		return " (link-local destinations need a zone, e.g. " + destination.IP.String() + "%eth0)"
+	case unreachable && linkLocal:
+		return " (check that zone " + destination.Zone + " names an interface with IPv6 enabled)"
+	case unreachable:
+		return " (this host may only have link-local IPv6 connectivity and no route to global addresses)"
+	case errors.Is(err, syscall.EADDRNOTAVAIL):
+		return " (no IPv6 source address is available for this destination)"
+	}
+	return ""
+}
+
+// Calls send once per interval until the run is finished. The sends are
+// planned at absolute times, start plus the intervals so far, so a late
+// wakeup delays that send only rather than every one after it. The schedule
+// follows the monotonic clock even under -wallclock, so a clock step doesn't
+// stall it.
+func (mp *MiniPinger) sendLoop(send func()) {
+	wait := mp.nextInterval()
+	planned := time.Now().Add(wait)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-mp.finished:
+			return
+		case <-timer.C:
+			// how much later than planned the send came round, not counting
+			// -max-outstanding pauses, which are intended
+			mp.recordDrift(time.Since(planned))
+			if !mp.waitForSlot() {
+				return
+			}
+			send()
+			if mp.sentAll() {
+				// no more ticks; the run ends once the last replies or
+				// timeouts are in
+				<-mp.finished
+				return
+			}
+			now := time.Now()
+			var skipped int
+			planned, skipped = nextSend(planned, mp.nextInterval(), now)
+			if skipped > 0 {
+				mp.mu.Lock()
+				mp.skippedSends += skipped
+				mp.mu.Unlock()
+			}
+			timer.Reset(planned.Sub(now))
+		}
+	}
+}
+
+// Returns when to send next after the send planned at planned, one interval
+// later, and how many slots were skipped to get there. A send that is due
+// already goes out at once to catch up, but when the loop fell a whole
+// interval or more behind, after a -max-outstanding pause or a stalled
+// process, the slots missed are skipped instead of being sent in a burst,
+// keeping to the same schedule from there.
+func nextSend(planned time.Time, interval time.Duration, now time.Time) (time.Time, int) {
+	next := planned.Add(interval)
+	if behind := now.Sub(next); interval > 0 && behind >= interval {
+		skipped := behind / interval
+		return next.Add(skipped * interval), int(skipped)
+	}
+	return next, 0
+}
+
+// Reports whether the -c packets have all been sent
+func (mp *MiniPinger) sentAll() bool {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	return mp.packetsSent >= mp.count
+}
+
+// Adds the drift of one send from its planned time to the drift statistics
+func (mp *MiniPinger) recordDrift(drift time.Duration) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	if mp.drifts == 0 || drift < mp.minDrift {
+		mp.minDrift = drift
+	}
+	if mp.drifts == 0 || drift > mp.maxDrift {
+		mp.maxDrift = drift
+	}
+	mp.totalDrift += drift
+	mp.drifts++
+}
+
+// Blocks while -max-outstanding packets are unanswered, until a reply or a
+// timeout frees a slot. Returns false if the run finished in the meantime.
+func (mp *MiniPinger) waitForSlot() bool {
+	for {
+		mp.mu.Lock()
+		full := mp.maxOutstanding > 0 && mp.outstanding >= mp.maxOutstanding
+		mp.mu.Unlock()
+		if !full {
+			return true
+		}
+		select {
+		case <-mp.released:
+		case <-mp.finished:
+			return false
+		}
+	}
+}
+
+// Returns the wait before the next send: the interval, moved at random by up
+// to the -jitter percentage so sends don't stay in step with periodic events
+func (mp *MiniPinger) nextInterval() time.Duration {
+	if mp.jitter <= 0 {
+		return mp.interval
+	}
+	spread := float64(mp.interval) * mp.jitter / 100
+	return mp.interval + time.Duration((mathrand.Float64()*2-1)*spread)
+}
+
+// Measures RTT by timing TCP connects instead of ICMP echoes, for networks that block ICMP
+func (mp *MiniPinger) runTCP() {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go mp.checkFinish(&wg)
+	mp.sendLoop(func() {
+		mp.sendTCPProbe(&wg)
+	})
+	wg.Wait()
+}
+
+// Starts a single TCP connect probe; a refused connection still counts as an answer from the host
+func (mp *MiniPinger) sendTCPProbe(wg *sync.WaitGroup) {
+	mp.mu.Lock()
+	seq := mp.packetsSent
+	mp.packetsSent++
+	sentAt := mp.now()
+	mp.addRecord(PacketRecord{Seq: seq, SentAt: sentAt, Status: statusPending})
+	mp.outstanding++
+	mp.signalProgress()
+	mp.mu.Unlock()
+	if mp.jsonl {
+		mp.emit(event{Type: "sent", Time: sentAt, Seq: seq})
+	}
+	address := net.JoinHostPort(mp.destination().String(), strconv.Itoa(mp.tcpPort))
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		conn, err := net.DialTimeout("tcp", address, mp.perPacketTimeout)
+		travelTime := mp.now().Sub(sentAt)
+		if err == nil {
+			conn.Close()
+		}
+		var netErr net.Error
+		status := statusReplied
+		switch {
+		case err == nil:
+		case errors.Is(err, syscall.ECONNREFUSED):
+			status = statusRefused
+		case errors.As(err, &netErr) && netErr.Timeout():
+			status = statusTimeout
+		default:
+			status = statusError
+		}
+		mp.mu.Lock()
+		mp.settle(seq, status)
+		if record := mp.record(seq); record != nil && (status == statusReplied || status == statusRefused) {
+			record.RTT = travelTime
+			mp.packetsReceived++
+		}
+		mp.mu.Unlock()
+		switch status {
+		case statusReplied, statusRefused:
+			mp.notifyReply(PacketResult{Seq: seq, From: mp.destination().String(), RTT: travelTime,
+				ReceivedAt: sentAt.Add(travelTime)})
+		case statusTimeout:
+			mp.notifyTimeout(seq)
+		}
+		mp.observe(seq, status == statusReplied || status == statusRefused)
+		if mp.jsonl {
+			e := event{Type: status, Time: mp.now(), Seq: seq}
+			if status == statusReplied || status == statusRefused {
+				e.Type = "reply"
+				e.RTT = float64(travelTime) / float64(time.Millisecond)
+			}
+			mp.emit(e)
+			return
+		}
+		if !mp.perPacketOutput() {
+			return
+		}
+		switch status {
+		case statusReplied:
+			fmt.Fprintf(mp.stdout, "connected to %s: seq=%d time=%v%s \n", address, seq, travelTime,
+				mp.timesNote(seq, sentAt.Add(travelTime)))
+		case statusRefused:
+			fmt.Fprintf(mp.stdout, "connection refused by %s: seq=%d time=%v%s \n", address, seq, travelTime,
+				mp.timesNote(seq, sentAt.Add(travelTime)))
+		case statusTimeout:
+			if mp.errorOutput() {
+				fmt.Fprintln(mp.stdout, "Request timed out.")
+			}
+		default:
+			if mp.errorOutput() {
+				fmt.Fprintln(mp.stdout, err)
+			}
+		}
+	}()
+}
+
+// Sends a packet
+func (mp *MiniPinger) sendPacket(conn icmpConn) error {
+	var mType icmp.Type
+	if mp.isIPv4 {
+		mType = ipv4.ICMPTypeEcho
+	} else {
+		mType = ipv6.ICMPTypeEchoRequest
+	}
+	mp.mu.Lock()
+	seq := mp.packetsSent
+	mp.mu.Unlock()
+	data := make([]byte, mp.packetSize)
+	copy(data, mp.payload)
+	if mp.stampsSeq() {
+		binary.BigEndian.PutUint32(data[tokenLength:], uint32(seq))
+	}
+	message := icmp.Message{
+		Type: mType,
+		Code: 0,
+		Body: &icmp.Echo{
+			ID:   mp.id,
+			Seq:  mp.wireSeq(seq),
+			Data: data,
+		},
+	}
+	if mp.timestamp {
+		message.Type = ipv4.ICMPTypeTimestamp
+		message.Body = &icmp.RawBody{Data: timestampRequest(mp.id, mp.wireSeq(seq), mp.now())}
+	}
+	b, err := message.Marshal(nil)
+	if err != nil {
+		return err
+	}
+	// only the sender touches the socket TTL, and the reader takes reply TTLs
+	// from per-packet control messages, so changing it between sends is safe.
+	// A constant TTL is set once, on the first send.
+	ttl := mp.ttlFor(seq)
+	if ttl != mp.socketTTL {
+		if err := mp.setTTL(conn, ttl); err != nil {
+			return err
+		}
+		mp.socketTTL = ttl
+	}
+	var destination net.Addr = mp.destination()
+	if mp.datagram {
+		target := mp.destination()
+		destination = &net.UDPAddr{IP: target.IP, Zone: target.Zone}
+	}
+	// ENOBUFS only means the send queue is full for a moment: retry a few
+	// times, and only count the packet as sent once it actually went out
+	for attempt := 1; ; attempt++ {
+		mp.markSent(seq)
+		err = mp.writeTo(conn, b, destination, seq, ttl)
+		if err == nil || !errors.Is(err, syscall.ENOBUFS) {
+			break
+		}
+		mp.unmarkSent(seq)
+		if attempt == enobufsAttempts {
+			return err
+		}
+		time.Sleep(time.Duration(attempt) * enobufsBackoff)
+	}
+	if err == nil {
+		mp.countBytesSent(len(b))
+	}
+	if err == nil && mp.pcap != nil {
+		mp.pcap.writePacket(mp.now(), nil, mp.destination().IP, ttl, b)
+	}
+	// -redundancy copies; the packet already counts as sent, so a copy
+	// that fails to go out only lowers its chances
+	for copies := 1; err == nil && copies < mp.redundancy; copies++ {
+		if copyErr := mp.writeTo(conn, b, destination, seq, ttl); copyErr != nil {
+			break
+		}
+		mp.countBytesSent(len(b))
+		if mp.pcap != nil {
+			mp.pcap.writePacket(mp.now(), nil, mp.destination().IP, ttl, b)
+		}
+	}
+	if mp.jsonl {
+		mp.emit(event{Type: "sent", Time: mp.now(), Seq: seq, Bytes: len(b)})
+	}
+	return err
+}
+
+// Sends the ICMP message b of packet seq to destination, under -ipid in an
+// IPv4 header of our own carrying the ID of seq
+func (mp *MiniPinger) writeTo(conn icmpConn, b []byte, destination net.Addr, seq int, ttl int) error {
+	if mp.headerConn == nil {
+		_, err := conn.WriteTo(b, destination)
+		return err
+	}
+	header := &ipv4.Header{
+		Version:  ipv4.Version,
+		Len:      ipv4.HeaderLen,
+		TotalLen: ipv4.HeaderLen + len(b),
+		ID:       ipIDFor(seq),
+		TTL:      ttl,
+		Protocol: 1,
+		Dst:      mp.destination().IP,
+	}
+	if mp.tos >= 0 {
+		header.TOS = mp.tos
+	}
+	return mp.headerConn.WriteTo(header, b, nil)
+}
+
+// Opens the socket -ipid sends through. An IPPROTO_RAW socket takes the IP
+// header from the caller, who can set the ID, and receives nothing, so it
+// doesn't need draining. The kernel fills in the source address and checksum.
+func openHeaderConn() (*ipv4.RawConn, error) {
+	c, err := net.ListenPacket("ip4:255", "0.0.0.0")
+	if err != nil {
+		return nil, err
+	}
+	rc, err := ipv4.NewRawConn(c)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return rc, nil
+}
+
+// Returns the IP ID packet seq is sent with under -ipid. It is never 0, as
+// Linux picks an ID of its own for raw packets with a zero ID.
+func ipIDFor(seq int) int {
+	return seq%0xffff + 1
+}
+
+// Sets the TTL, or the hop limit for IPv6, of the packets sent next
+func (mp *MiniPinger) setTTL(conn icmpConn, ttl int) error {
+	if mp.isIPv4 {
+		return conn.IPv4PacketConn().SetTTL(ttl)
+	}
+	return conn.IPv6PacketConn().SetHopLimit(ttl)
+}
+
+// Returns the TTL packet seq is sent with: -t, or under -ttl-sweep the next
+// step of the range after -probes-per-hop packets, starting over at its
+// beginning once the end is passed
+func (mp *MiniPinger) ttlFor(seq int) int {
+	if mp.sweepTo == 0 {
+		return mp.ttl
+	}
+	return mp.sweepFrom + seq/mp.hopProbes()%(mp.sweepTo-mp.sweepFrom+1)
+}
+
+// Returns how many packets go out with each TTL of a -ttl-sweep
+func (mp *MiniPinger) hopProbes() int {
+	if mp.probesPerHop < 1 {
+		return 1
+	}
+	return mp.probesPerHop
+}
+
+// Returns which pass over the -ttl-sweep range packet seq belongs to
+func (mp *MiniPinger) sweepPass(seq int) int {
+	return seq / (mp.hopProbes() * (mp.sweepTo - mp.sweepFrom + 1))
+}
+
+// Sends a UDP datagram to the probed port. The payload carries the session token
+// and the sequence number so the ICMP port unreachable quoting it can be matched.
+func (mp *MiniPinger) sendUDPProbe(conn *net.UDPConn) error {
+	mp.mu.Lock()
+	seq := mp.packetsSent
+	mp.mu.Unlock()
+	size := mp.packetSize
+	if size < tokenLength+4 {
+		size = tokenLength + 4
+	}
+	payload := make([]byte, size)
+	copy(payload, mp.token)
+	binary.BigEndian.PutUint32(payload[tokenLength:], uint32(seq))
+	mp.markSent(seq)
+	target := mp.destination()
+	destination := &net.UDPAddr{IP: target.IP, Port: mp.udpPort, Zone: target.Zone}
+	_, err := conn.WriteTo(payload, destination)
+	if err == nil {
+		mp.countBytesSent(len(payload))
+	}
+	if mp.jsonl {
+		mp.emit(event{Type: "sent", Time: mp.now(), Seq: seq, Bytes: len(payload)})
+	}
+	return err
+}
+
+// Builds the body of an ICMP Timestamp request (RFC 792): identifier, sequence
+// number, then the originate, receive and transmit timestamps, of which only
+// the originate one is filled in by the sender
+func timestampRequest(id int, seq int, now time.Time) []byte {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint16(b[0:2], uint16(id))
+	binary.BigEndian.PutUint16(b[2:4], uint16(seq))
+	binary.BigEndian.PutUint32(b[4:8], msSinceMidnight(now))
+	return b
+}
+
+// Returns t as milliseconds since midnight UTC, the unit of ICMP timestamps
+func msSinceMidnight(t time.Time) uint32 {
+	t = t.UTC()
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	return uint32(t.Sub(midnight) / time.Millisecond)
+}
@@ -0,0 +1,252 @@
+package miniping
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+)
+
+// -jitter moves each wait before a send by up to its percentage of the
+// interval either way, and the sends follow
+func TestJitter(t *testing.T) {
+	mp := testPinger("192.0.2.1")
+	mp.interval = 100 * time.Millisecond
+	mp.jitter = 25
+	var shorter, longer bool
+	for i := 0; i < 1000; i++ {
+		wait := mp.nextInterval()
+		if wait < 75*time.Millisecond || wait > 125*time.Millisecond {
+			t.Fatalf("wait %v, want within 25%% of %v", wait, mp.interval)
+		}
+		shorter = shorter || wait < mp.interval
+		longer = longer || wait > mp.interval
+	}
+	if !shorter || !longer {
+		t.Errorf("waits only shorter %v or longer %v than the interval", shorter, longer)
+	}
+
+	mp = testPinger("192.0.2.1")
+	mp.interval = 10 * time.Millisecond
+	mp.jitter = 50
+	var sends []time.Time
+	mp.sendLoop(func() {
+		sends = append(sends, time.Now())
+		if len(sends) == 10 {
+			mp.stop(stopCount)
+		}
+	})
+	for i := 1; i < len(sends); i++ {
+		// timers fire late at times, but never early
+		if gap := sends[i].Sub(sends[i-1]); gap < 5*time.Millisecond {
+			t.Errorf("send %d came %v after the one before, want at least 5ms", i, gap)
+		}
+	}
+}
+
+func TestSendErrorHint(t *testing.T) {
+	tests := []struct {
+		target string
+		err    error
+		want   string
+	}{
+		{"192.0.2.1", syscall.ENETUNREACH, ""},
+		{"fe80::1%lo", syscall.EDESTADDRREQ, "link-local destinations need a zone"},
+		{"fe80::1%lo", syscall.EHOSTUNREACH, "check that zone lo names an interface"},
+		{"2001:db8::1", syscall.ENETUNREACH, "only have link-local IPv6 connectivity"},
+		{"2001:db8::1", syscall.EADDRNOTAVAIL, "no IPv6 source address"},
+		{"2001:db8::1", errors.New("other"), ""},
+	}
+	for _, tt := range tests {
+		mp := testPinger(tt.target)
+		hint := mp.sendErrorHint(tt.err)
+		if tt.want == "" && hint != "" || !strings.Contains(hint, tt.want) {
+			t.Errorf("%s, %v: hint %q, want %q", tt.target, tt.err, hint, tt.want)
+		}
+	}
+}
+
+// Each send goes out with the TTL meant for it, a sweep's changing per packet
+func TestTTLPerSend(t *testing.T) {
+	tests := []struct {
+		name      string
+		sweepFrom int
+		sweepTo   int
+		want      []int
+	}{
+		{"constant", 0, 0, []int{64, 64, 64, 64}},
+		{"sweep", 1, 3, []int{1, 2, 3, 1}},
+	}
+	for _, tt := range tests {
+		mp := testPinger("127.0.0.1")
+		mp.sweepFrom, mp.sweepTo = tt.sweepFrom, tt.sweepTo
+		conn := newFakeConn(t)
+		for range tt.want {
+			if err := mp.sendPacket(conn); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+		}
+		if !reflect.DeepEqual(conn.ttls, tt.want) {
+			t.Errorf("%s: sent with ttls %v, want %v", tt.name, conn.ttls, tt.want)
+		}
+	}
+}
+
+// A socket whose send queue is full for the first failures sends
+type fullQueueConn struct {
+	*fakeConn
+	failures int
+}
+
+func (c *fullQueueConn) WriteTo(b []byte, to net.Addr) (int, error) {
+	if c.failures > 0 {
+		c.failures--
+		return 0, &net.OpError{Op: "write", Net: "ip4:icmp", Err: os.NewSyscallError("sendto", syscall.ENOBUFS)}
+	}
+	return c.fakeConn.WriteTo(b, to)
+}
+
+func TestENOBUFSRetry(t *testing.T) {
+	tests := []struct {
+		failures int
+		fails    bool
+		sent     int
+	}{
+		{0, false, 1},
+		{1, false, 1},
+		{enobufsAttempts, true, 0},
+	}
+	for _, tt := range tests {
+		mp := testPinger("192.0.2.1")
+		conn := &fullQueueConn{newFakeConn(t), tt.failures}
+		err := mp.sendPacket(conn)
+		if (err != nil) != tt.fails {
+			t.Errorf("%d failures: error %v", tt.failures, err)
+		}
+		if mp.packetsSent != tt.sent || len(mp.packets) != tt.sent || mp.outstanding != tt.sent {
+			t.Errorf("%d failures: %d sent, %d records, %d outstanding, want %d",
+				tt.failures, mp.packetsSent, len(mp.packets), mp.outstanding, tt.sent)
+		}
+		mp.stop(stopCount)
+	}
+}
+
+// With -probes-per-hop each probe of a TTL is listed, with the address that
+// answered it whenever that changes and * for the unanswered ones
+func TestProbesPerHop(t *testing.T) {
+	mp := testPinger("192.0.2.1")
+	mp.stdout = io.Discard
+	mp.sweepFrom, mp.sweepTo = 1, 2
+	mp.probesPerHop = 3
+	base := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	mp.now = func() time.Time {
+		return base
+	}
+	for seq := 0; seq < 6; seq++ {
+		mp.markSent(seq)
+	}
+	exceeded := func(seq int, from string, rtt time.Duration) {
+		r := &reply{src: &net.IPAddr{IP: net.ParseIP(from)}, receivedAt: base.Add(rtt)}
+		mp.handleTimeExceeded(r, &icmp.TimeExceeded{Data: quotedEcho(t, mp, seq)})
+	}
+	// two routers sharing the first hop, the third probe lost
+	exceeded(0, "10.0.0.1", time.Millisecond)
+	exceeded(1, "10.0.0.2", 2*time.Millisecond)
+	exceeded(3, "10.0.1.1", 3*time.Millisecond)
+	exceeded(4, "10.0.1.1", 4*time.Millisecond)
+	exceeded(5, "10.0.1.1", 5*time.Millisecond)
+	mp.stop(stopCount)
+	var out strings.Builder
+	mp.printSweep(&out, mp.stats().Packets)
+	want := "ttl sweep:\n" +
+		"  ttl 1: 10.0.0.1  1ms  10.0.0.2  2ms  *\n" +
+		"  ttl 2: 10.0.1.1  3ms  4ms  5ms\n"
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+// Once the -c packets are sent the send loop takes no more ticks
+func TestNoTickAfterLastSend(t *testing.T) {
+	mp := testPinger("192.0.2.1")
+	mp.interval = 5 * time.Millisecond
+	done := make(chan struct{})
+	go func() {
+		mp.sendLoop(func() {
+			mp.mu.Lock()
+			seq := mp.packetsSent
+			mp.mu.Unlock()
+			mp.markSent(seq)
+		})
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	mp.mu.Lock()
+	sent, ticks := mp.packetsSent, mp.drifts
+	mp.mu.Unlock()
+	if sent != 2 || ticks != 2 {
+		t.Errorf("%d ticks sent %d packets, want 2 and 2", ticks, sent)
+	}
+	mp.stop(stopCount)
+	<-done
+}
+
+// nextSend keeps to the ideal schedule, skipping the slots already past
+func TestNextSend(t *testing.T) {
+	const interval = 100 * time.Millisecond
+	planned := time.Unix(1000, 0)
+	tests := []struct {
+		name string
+		// when the send planned at planned went out
+		sentAfter time.Duration
+		want      time.Duration
+		skipped   int
+	}{
+		{"on time", 0, interval, 0},
+		{"a little late", 30 * time.Millisecond, interval, 0},
+		{"due already, caught up at once", 150 * time.Millisecond, interval, 0},
+		{"an interval behind", 200 * time.Millisecond, 2 * interval, 1},
+		{"several intervals behind", 570 * time.Millisecond, 5 * interval, 4},
+	}
+	for _, tt := range tests {
+		next, skipped := nextSend(planned, interval, planned.Add(tt.sentAfter))
+		if got := next.Sub(planned); got != tt.want || skipped != tt.skipped {
+			t.Errorf("%s: next send after %v skipping %d, want after %v skipping %d", tt.name, got, skipped, tt.want, tt.skipped)
+		}
+	}
+	if next, skipped := nextSend(planned, 0, planned.Add(time.Second)); !next.Equal(planned) || skipped != 0 {
+		t.Errorf("zero interval: next send at %v skipping %d, want at once", next.Sub(planned), skipped)
+	}
+}
+
+// Feeds the send loop's bookkeeping send times from a clock of our own: the
+// drift is taken against the ideal schedule, and slots a stall skipped over
+// are counted instead of sent in a burst
+func TestSendDriftFollowsTheSchedule(t *testing.T) {
+	mp := testPinger("192.0.2.1")
+	const interval = 100 * time.Millisecond
+	start := time.Unix(1000, 0)
+	planned := start.Add(interval)
+	sends := []time.Duration{100, 205, 330, 650, 651}
+	for _, sent := range sends {
+		now := start.Add(sent * time.Millisecond)
+		mp.recordDrift(now.Sub(planned))
+		var skipped int
+		planned, skipped = nextSend(planned, interval, now)
+		mp.skippedSends += skipped
+	}
+	stats := mp.stats()
+	if stats.MinDrift != 0 || stats.MaxDrift != 250 || stats.AvgDrift != 67.2 {
+		t.Errorf("drift min/avg/max %v/%v/%v ms, want 0/67.2/250", stats.MinDrift, stats.AvgDrift, stats.MaxDrift)
+	}
+	if stats.SkippedSends != 1 {
+		t.Errorf("%d send slots skipped, want 1", stats.SkippedSends)
+	}
+}
@@ -0,0 +1,131 @@
+package miniping
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Kinds of ICMP socket listen can open
+const (
+	modeRaw      = "raw"
+	modeDatagram = "datagram"
+)
+
+// Opens the ICMP socket and returns which kind it is: a raw one if we are
+// allowed to, otherwise an unprivileged datagram ("ping") socket. On the
+// latter the kernel fills its own identifier into every request, so that
+// becomes the identifier replies are matched by. -local-port binds a datagram
+// socket to the port given, and is refused where a raw socket would be used.
+func (mp *MiniPinger) listen() (icmpConn, string, error) {
+	conn, err := mp.listenPacket(mp.getNetwork(), "::")
+	if err == nil && mp.localPort > 0 {
+		conn.Close()
+		return nil, "", &PingError{Kind: ErrInvalidArgument, Err: errors.New(
+			"-local-port binds a datagram ICMP socket, but this run may open a raw one, " +
+				"which has no port; leave -local-port out or run without the raw socket privilege")}
+	}
+	if err == nil || !(errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES)) {
+		return conn, modeRaw, err
+	}
+	if mp.localPort > 0 {
+		bound, bindErr := mp.listenBound()
+		if bindErr != nil {
+			return nil, "", bindErr
+		}
+		return bound, modeDatagram, nil
+	}
+	network, address := "udp4", "0.0.0.0"
+	if !mp.isIPv4 {
+		network, address = "udp6", "::"
+	}
+	conn, datagramErr := mp.listenPacket(network, address)
+	if datagramErr != nil {
+		// the missing privilege for the raw socket is the more useful error
+		return nil, "", err
+	}
+	if local, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		mp.id = local.Port
+	}
+	mp.datagram = true
+	return conn, modeDatagram, nil
+}
+
+// Opens an ICMP socket with icmp.ListenPacket
+func listenICMP(network, address string) (icmpConn, error) {
+	conn, err := icmp.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Opens a datagram ICMP socket bound to the -local-port and takes the port as
+// the identifier
+func (mp *MiniPinger) listenBound() (icmpConn, error) {
+	conn, err := bindDatagramICMP(mp.isIPv4, mp.localPort)
+	if errors.Is(err, syscall.EADDRINUSE) {
+		return nil, fmt.Errorf("-local-port %d is already in use by another datagram ICMP socket", mp.localPort)
+	}
+	if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) {
+		return nil, &PingError{Kind: ErrPermissionDenied, Err: fmt.Errorf("-local-port needs a datagram ICMP socket, "+
+			"which Linux only offers to the groups in net.ipv4.ping_group_range (%v)", err)}
+	}
+	if err != nil {
+		return nil, err
+	}
+	mp.id = mp.localPort
+	mp.datagram = true
+	return conn, nil
+}
+
+// Where the receive time of a reply came from
+const (
+	stampSoftware  = "kernel"
+	stampUserspace = "userspace"
+)
+
+// IPv4 options -via sends
+const (
+	ipOptNOP  = 1
+	ipOptLSRR = 131
+)
+
+// Returns the IP_OPTIONS value for a loose source route through gateway: a
+// NOP to align the address, then the LSRR option with its pointer at the
+// first address. Linux sends such a packet to the first address listed and
+// appends the destination to the route.
+func sourceRouteOption(gateway net.IP) []byte {
+	option := []byte{ipOptNOP, ipOptLSRR, 3 + net.IPv4len, 4}
+	return append(option, gateway.To4()...)
+}
+
+// Returns the socket under an ICMP connection
+func packetConn(conn icmpConn, isIPv4 bool) net.PacketConn {
+	if isIPv4 {
+		return conn.IPv4PacketConn().PacketConn
+	}
+	return conn.IPv6PacketConn().PacketConn
+}
+
+// An ICMP socket with its per-family views: an icmp.PacketConn, the bound
+// datagram socket of -local-port, or a stand-in for the network in tests
+type icmpConn interface {
+	net.PacketConn
+	IPv4PacketConn() *ipv4.PacketConn
+	IPv6PacketConn() *ipv6.PacketConn
+}
+
+// Returns the network type depending on whether the address is ipv4 or ipv6
+func (mp *MiniPinger) getNetwork() string {
+	if mp.isIPv4 {
+		return "ip4:icmp"
+	} else {
+		return "ip6:ipv6-icmp"
+	}
+}
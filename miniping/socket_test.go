@@ -0,0 +1,115 @@
+package miniping
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Without the privilege for a raw socket the pinger falls back to a datagram
+// one, and matches replies by the identifier the kernel gives its requests
+func TestDatagramFallback(t *testing.T) {
+	mp := testPinger("127.0.0.1")
+	conn := newFakeConn(t)
+	conn.up["127.0.0.1"] = true
+	var networks []string
+	mp.listenPacket = func(network, address string) (icmpConn, error) {
+		networks = append(networks, network)
+		if network == "ip4:icmp" {
+			return nil, &net.OpError{Op: "listen", Net: network, Err: os.NewSyscallError("socket", syscall.EPERM)}
+		}
+		return conn, nil
+	}
+	if err := mp.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"ip4:icmp", "udp4"}; !reflect.DeepEqual(networks, want) {
+		t.Errorf("opened %v, want %v", networks, want)
+	}
+	if !mp.datagram || mp.id != conn.LocalAddr().(*net.UDPAddr).Port {
+		t.Errorf("datagram %v with identifier %d, want the local port %v", mp.datagram, mp.id, conn.LocalAddr())
+	}
+	// the run may send one more packet than -c before it notices it is done,
+	// whose reply needn't make it in
+	if stats := mp.Stats(); stats.Received < mp.count {
+		t.Errorf("%d replies to %d requests, want the %d asked for", stats.Received, stats.Sent, mp.count)
+	}
+}
+
+// Any other failure of the raw socket is reported as is
+func TestRawSocketError(t *testing.T) {
+	mp := testPinger("127.0.0.1")
+	mp.listenPacket = func(network, address string) (icmpConn, error) {
+		if network != "ip4:icmp" {
+			t.Errorf("opened %s", network)
+		}
+		return nil, os.NewSyscallError("socket", syscall.EMFILE)
+	}
+	if _, _, err := mp.listen(); !errors.Is(err, syscall.EMFILE) {
+		t.Errorf("error %v, want EMFILE", err)
+	}
+}
+
+// Pings over a datagram ICMP socket bound to -local-port, which the kernel
+// puts in the identifier, so only replies matched by the port are counted
+func TestLocalPortIsTheIdentifier(t *testing.T) {
+	const port = 47321
+	mp := testPinger("127.0.0.1")
+	mp.localPort = port
+	conn, err := mp.listenBound()
+	if err != nil {
+		t.Skipf("no datagram ICMP socket to bind here: %v", err)
+	}
+	mp.open = func() (icmpConn, string, error) {
+		return conn, modeDatagram, nil
+	}
+	mp.perPacketTimeout = time.Second
+	if err := mp.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if mp.id != port {
+		t.Errorf("identifier %d, want the port %d", mp.id, port)
+	}
+	if stats := mp.stats(); stats.Received != stats.Sent {
+		t.Errorf("%d of %d replies matched", stats.Received, stats.Sent)
+	}
+}
+
+// -local-port is refused where the run would get a raw socket, which has no port
+func TestLocalPortNeedsDatagramSocket(t *testing.T) {
+	mp := testPinger("127.0.0.1")
+	mp.localPort = 47321
+	conn := newFakeConn(t)
+	mp.listenPacket = func(network, address string) (icmpConn, error) {
+		return conn, nil
+	}
+	if _, _, err := mp.listen(); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("error %v, want ErrInvalidArgument", err)
+	}
+}
+
+// The -via option is the word-aligned loose source route to the gateway
+func TestSourceRouteOption(t *testing.T) {
+	tests := []struct {
+		gateway string
+		want    []byte
+	}{
+		{"192.0.2.1", []byte{ipOptNOP, ipOptLSRR, 7, 4, 192, 0, 2, 1}},
+		{"10.1.2.3", []byte{ipOptNOP, ipOptLSRR, 7, 4, 10, 1, 2, 3}},
+	}
+	for _, tt := range tests {
+		got := sourceRouteOption(net.ParseIP(tt.gateway))
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("via %s: option % x, want % x", tt.gateway, got, tt.want)
+		}
+		// IP_OPTIONS takes whole 32-bit words
+		if len(got)%4 != 0 {
+			t.Errorf("via %s: option of %d bytes isn't word aligned", tt.gateway, len(got))
+		}
+	}
+}
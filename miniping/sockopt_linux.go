@@ -0,0 +1,168 @@
+package miniping
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Sets the size of the kernel's receive buffer of the socket to size with
+// SO_RCVBUF and returns the size it granted, which Linux doubles to allow for
+// its bookkeeping and caps at net.core.rmem_max
+func setReceiveBuffer(conn net.PacketConn, size int) (int, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0, fmt.Errorf("%T doesn't allow setting socket options", conn)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var granted int
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, size); sockErr == nil {
+			granted, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	return granted, sockErr
+}
+
+// SO_TIMESTAMPING and its flags from linux/net_tstamp.h, which the syscall
+// package doesn't all define
+const (
+	soTimestamping            = 37
+	sofTimestampingRxSoftware = 1 << 3
+	sofTimestampingSoftware   = 1 << 4
+)
+
+// Asks the kernel to timestamp every packet the socket receives with
+// SO_TIMESTAMPING as it comes in. Only software stamps are asked for: the
+// NIC's hardware ones run on its own clock, not the system clock the sends
+// are timed with.
+func enableTimestamping(conn net.PacketConn) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("%T doesn't allow setting socket options", conn)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	flags := sofTimestampingRxSoftware | sofTimestampingSoftware
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soTimestamping, flags)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// Returns the receive time in the SCM_TIMESTAMPING control message in oob, or
+// the zero time if there is none. Of the three timestamps in the message only
+// the first, the kernel's, is in the clock the send times are taken from.
+func receiveTimestamp(oob []byte) (time.Time, string) {
+	messages, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return time.Time{}, stampUserspace
+	}
+	for _, m := range messages {
+		if m.Header.Level != syscall.SOL_SOCKET || m.Header.Type != soTimestamping {
+			continue
+		}
+		if len(m.Data) < 3*int(unsafe.Sizeof(syscall.Timespec{})) {
+			continue
+		}
+		stamps := (*[3]syscall.Timespec)(unsafe.Pointer(&m.Data[0]))
+		if stamps[0].Sec != 0 || stamps[0].Nsec != 0 {
+			return time.Unix(stamps[0].Unix()), stampSoftware
+		}
+	}
+	return time.Time{}, stampUserspace
+}
+
+// Opens a datagram ICMP socket bound to port, which icmp.ListenPacket has no
+// way to ask for
+func bindDatagramICMP(isIPv4 bool, port int) (icmpConn, error) {
+	family, proto := syscall.AF_INET, syscall.IPPROTO_ICMP
+	var address syscall.Sockaddr = &syscall.SockaddrInet4{Port: port}
+	if !isIPv4 {
+		family, proto = syscall.AF_INET6, syscall.IPPROTO_ICMPV6
+		address = &syscall.SockaddrInet6{Port: port}
+	}
+	s, err := syscall.Socket(family, syscall.SOCK_DGRAM, proto)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	// ping sockets start out with SO_REUSEADDR set (the IPPROTO_ICMP entries
+	// of inetsw_array in net/ipv4/af_inet.c and inetsw6_array in
+	// net/ipv6/af_inet6.c carry INET_PROTOSW_REUSE), which would let the bind
+	// share a port already in use and split the replies between the sockets
+	if err := syscall.SetsockoptInt(s, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 0); err != nil {
+		syscall.Close(s)
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+	if err := syscall.Bind(s, address); err != nil {
+		syscall.Close(s)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	f := os.NewFile(uintptr(s), "datagram icmp")
+	c, err := net.FilePacketConn(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	return &boundICMPConn{PacketConn: c, p4: ipv4.NewPacketConn(c), p6: ipv6.NewPacketConn(c)}, nil
+}
+
+// A datagram ICMP socket bound by bindDatagramICMP, with the per-family views
+// icmp.PacketConn has
+type boundICMPConn struct {
+	net.PacketConn
+	p4 *ipv4.PacketConn
+	p6 *ipv6.PacketConn
+}
+
+func (c *boundICMPConn) IPv4PacketConn() *ipv4.PacketConn {
+	return c.p4
+}
+
+func (c *boundICMPConn) IPv6PacketConn() *ipv6.PacketConn {
+	return c.p6
+}
+
+// Makes conn send its packets to the destination through gateway, whatever
+// the routing table says, with a loose source route. Only Linux takes the
+// option this way, and routers are free to drop source routed packets.
+func setSourceRoute(conn net.PacketConn, gateway net.IP) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("%T doesn't allow setting socket options", conn)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptString(int(fd), syscall.IPPROTO_IP, syscall.IP_OPTIONS, string(sourceRouteOption(gateway)))
+	})
+	if err != nil {
+		return err
+	}
+	if sockErr != nil {
+		return fmt.Errorf("can't set the source route via %s: %v", gateway, sockErr)
+	}
+	return nil
+}
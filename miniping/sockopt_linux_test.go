@@ -0,0 +1,96 @@
+package miniping
+
+import (
+	"bytes"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// SO_RCVBUF is set on the socket, and Linux grants double the size asked for
+func TestSetReceiveBuffer(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	granted, err := setReceiveBuffer(conn, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if granted != 2*4096 {
+		t.Errorf("granted %d bytes, want %d", granted, 2*4096)
+	}
+}
+
+// A socket with timestamping on gets the kernel's receive time with each
+// packet. The kernel turns stamping on for the system in the background, so
+// the first few packets may go without.
+func TestReceiveTimestamp(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := enableTimestamping(conn); err != nil {
+		t.Fatal(err)
+	}
+	b, oob := make([]byte, 64), make([]byte, 256)
+	var stamp time.Time
+	source := stampUserspace
+	for try := 0; try < 10 && source != stampSoftware; try++ {
+		before := time.Now()
+		if _, err := conn.WriteTo([]byte("stamp me"), conn.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, oobn, _, _, err := conn.ReadMsgUDP(b, oob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stamp, source = receiveTimestamp(oob[:oobn])
+		if source == stampSoftware && (stamp.Before(before) || stamp.After(time.Now())) {
+			t.Errorf("timestamp %v, want one after %v", stamp, before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if source != stampSoftware {
+		t.Errorf("%s timestamps, want the kernel's", source)
+	}
+	if _, source := receiveTimestamp(nil); source != stampUserspace {
+		t.Errorf("%s timestamp without a control message", source)
+	}
+}
+
+// setSourceRoute leaves the loose source route in the socket's IP options
+func TestSetSourceRoute(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	gateway := net.ParseIP("192.0.2.1")
+	if err := setSourceRoute(conn, gateway); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := make([]byte, 40)
+	size := uint32(len(options))
+	var errno syscall.Errno
+	raw.Control(func(fd uintptr) {
+		// the syscall package has no getsockopt for a byte string
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_IP, syscall.IP_OPTIONS,
+			uintptr(unsafe.Pointer(&options[0])), uintptr(unsafe.Pointer(&size)), 0)
+	})
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	if want := sourceRouteOption(gateway); !bytes.Equal(options[:size], want) {
+		t.Errorf("IP options % x, want % x", options[:size], want)
+	}
+}
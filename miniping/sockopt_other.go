@@ -0,0 +1,34 @@
+//go:build !linux
+// +build !linux
+
+package miniping
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"time"
+)
+
+// Socket options mini-ping only sets on Linux: elsewhere these report that
+// they aren't supported
+
+func setReceiveBuffer(conn net.PacketConn, size int) (int, error) {
+	return 0, fmt.Errorf("setting the socket receive buffer isn't supported on %s", runtime.GOOS)
+}
+
+func enableTimestamping(conn net.PacketConn) error {
+	return fmt.Errorf("receive timestamps need Linux, not %s", runtime.GOOS)
+}
+
+func receiveTimestamp(oob []byte) (time.Time, string) {
+	return time.Time{}, stampUserspace
+}
+
+func bindDatagramICMP(isIPv4 bool, port int) (icmpConn, error) {
+	return nil, fmt.Errorf("datagram ICMP sockets aren't supported on %s", runtime.GOOS)
+}
+
+func setSourceRoute(conn net.PacketConn, gateway net.IP) error {
+	return fmt.Errorf("-via needs Linux, not %s", runtime.GOOS)
+}
@@ -0,0 +1,838 @@
+package miniping
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Number of the latest packet records -stream-stats keeps besides the one of
+// the packet just sent; older ones are folded into the aggregates
+const streamWindow = 1024
+
+// Sets the status of seq, freeing its -max-outstanding slot if it was still
+// pending. The caller must hold mp.mu.
+func (mp *MiniPinger) settle(seq int, status string) {
+	record := mp.record(seq)
+	if record == nil {
+		return
+	}
+	if record.Status == statusPending {
+		mp.outstanding--
+		select {
+		case mp.released <- struct{}{}:
+		default:
+		}
+		mp.signalProgress()
+	}
+	record.Status = status
+}
+
+// Returns the record of packet seq, or nil if -stream-stats already folded it
+// into the aggregates. The caller must hold mp.mu.
+func (mp *MiniPinger) record(seq int) *PacketRecord {
+	i := seq - mp.packetBase
+	if i < 0 || i >= len(mp.packets) {
+		return nil
+	}
+	return &mp.packets[i]
+}
+
+// Adds the record of a packet just sent. Under -stream-stats the oldest
+// records are first folded into the aggregates while more than streamWindow
+// are kept, so the new one never pushes a record out before its send went
+// through; a packet still unanswered by then counts as lost, and a reply to
+// it coming even later is ignored. The caller must hold mp.mu.
+func (mp *MiniPinger) addRecord(record PacketRecord) {
+	for mp.streamStats && len(mp.packets) > streamWindow {
+		oldest := mp.packets[0]
+		if oldest.Status == statusPending {
+			mp.settle(oldest.Seq, statusTimeout)
+			oldest.Status = statusTimeout
+			delete(mp.timeSent, oldest.Seq)
+			if timer, ok := mp.timers[oldest.Seq]; ok {
+				timer.Stop()
+				delete(mp.timers, oldest.Seq)
+			}
+		}
+		if value, ok := mp.rttSample(oldest); ok {
+			mp.folded.rtt.add(value)
+		}
+		if oldest.Status == statusError {
+			mp.folded.errors++
+		}
+		// settled above, so a packet folded unanswered extends the streak
+		mp.addToStreak(&mp.folded.losses, oldest)
+		if oldest.Status == statusTimeout {
+			mp.folded.lostSeqs = append(mp.folded.lostSeqs, oldest.Seq)
+		}
+		if oldest.Status == statusReplied {
+			if mp.folded.responders == nil {
+				mp.folded.responders = make(map[string]responderTotal)
+			}
+			mp.folded.responders[oldest.From] = mp.folded.responders[oldest.From].add(oldest.RTT)
+		}
+		// append copies only what's left once it outgrows the array, which
+		// frees the folded records
+		mp.packets = mp.packets[1:]
+		mp.packetBase++
+	}
+	mp.packets = append(mp.packets, record)
+}
+
+// Returns the RTT of a packet in milliseconds if it goes into the RTT statistics
+func (mp *MiniPinger) rttSample(record PacketRecord) (float64, bool) {
+	if record.Status != statusReplied && record.Status != statusRefused {
+		return 0, false
+	}
+	if record.OutOfOrder && mp.excludeReordered {
+		return 0, false
+	}
+	return float64(record.RTT) / float64(time.Millisecond), true
+}
+
+// What -stream-stats keeps of the packet records it folds
+type foldedPackets struct {
+	rtt    rttAccumulator
+	errors int
+	losses lossStreak
+	// the sequence numbers of the lost packets, which are few next to the
+	// records folded
+	lostSeqs []int
+	// the replies by the address they came from, an empty one standing for
+	// the destination
+	responders map[string]responderTotal
+}
+
+// The replies from one address and their summed RTT
+type responderTotal struct {
+	replies int
+	rtt     time.Duration
+}
+
+// Returns the total with one more reply taking rtt
+func (t responderTotal) add(rtt time.Duration) responderTotal {
+	return responderTotal{t.replies + 1, t.rtt + rtt}
+}
+
+// Tracks runs of consecutive lost packets, fed one packet at a time in
+// sequence order
+type lossStreak struct {
+	current int
+	longest int
+}
+
+// Adds the packet of record to the loss streaks the way the loss counts it: a
+// packet timed out, or still pending unless -exclude-pending leaves it out,
+// is lost, and one left out neither extends a streak nor ends it
+func (mp *MiniPinger) addToStreak(l *lossStreak, record PacketRecord) {
+	if record.Status == statusPending && mp.excludePending {
+		return
+	}
+	l.add(record.Status == statusTimeout || record.Status == statusPending)
+}
+
+// Adds the next packet, lost or not
+func (l *lossStreak) add(lost bool) {
+	if !lost {
+		l.current = 0
+		return
+	}
+	l.current++
+	if l.current > l.longest {
+		l.longest = l.current
+	}
+}
+
+// Running aggregates of RTT samples, in milliseconds, that give the mean and
+// the standard deviation without keeping the samples
+type rttAccumulator struct {
+	count      int
+	sum        float64
+	sumSquares float64
+	min        float64
+	max        float64
+}
+
+func (a *rttAccumulator) add(value float64) {
+	if a.count == 0 || value < a.min {
+		a.min = value
+	}
+	if a.count == 0 || value > a.max {
+		a.max = value
+	}
+	a.count++
+	a.sum += value
+	a.sumSquares += value * value
+}
+
+func (a *rttAccumulator) mean() float64 {
+	if a.count == 0 {
+		return 0
+	}
+	return a.sum / float64(a.count)
+}
+
+// Returns the population standard deviation of the samples added
+func (a *rttAccumulator) stddev() float64 {
+	if a.count == 0 {
+		return 0
+	}
+	mean := a.mean()
+	variance := a.sumSquares/float64(a.count) - mean*mean
+	if variance < 0 {
+		// rounding when all samples are about equal
+		return 0
+	}
+	return math.Sqrt(variance)
+}
+
+// Returns the number of routers between here and the destination for
+// -expect-hops, and where it comes from: under -ttl-sweep the lowest TTL that
+// reached the destination, less the destination itself, and otherwise the
+// hop count inferred from the reply TTL seen most often, ties going to the
+// shorter path. False if no reply tells.
+func (mp *MiniPinger) hopCount(stats Stats) (int, string, bool) {
+	if mp.sweepTo > 0 {
+		lowest := 0
+		for _, record := range stats.Packets {
+			if ttl := mp.ttlFor(record.Seq); record.Status == statusReplied && (lowest == 0 || ttl < lowest) {
+				lowest = ttl
+			}
+		}
+		return lowest - 1, "from the ttl sweep", lowest > 0
+	}
+	seen := make(map[int]int)
+	for _, record := range stats.Packets {
+		if record.Status == statusReplied && record.TTL > 0 {
+			_, hops := inferHops(record.TTL)
+			seen[hops]++
+		}
+	}
+	best, ok := 0, false
+	for hops, n := range seen {
+		if !ok || n > seen[best] || (n == seen[best] && hops < best) {
+			best, ok = hops, true
+		}
+	}
+	return best, "inferred from the reply ttl", ok
+}
+
+// Computes the statistics of the packets recorded so far
+func (mp *MiniPinger) stats() Stats {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	stats := Stats{
+		Sent:            mp.packetsSent,
+		Received:        mp.packetsReceived,
+		Elapsed:         mp.now().Sub(mp.startTime),
+		Packets:         append([]PacketRecord(nil), mp.packets...),
+		StopReason:      mp.stopReason,
+		TTLChanges:      mp.ttlChanges,
+		TOSRemarked:     mp.tosRemarked,
+		ShortReplies:    mp.shortReplies,
+		Corrupted:       mp.corruptReplies,
+		Reordered:       mp.reordered,
+		Duplicates:      mp.duplicates,
+		IPIDsChecked:    mp.ipIDsChecked,
+		IPIDsRewritten:  mp.ipIDsRewritten,
+		RejectedSources: mp.rejectedSources,
+		RouterErrors:    mp.routerErrors,
+		Drained:         mp.drainedReplies,
+		BytesSent:       mp.bytesSent,
+		BytesReceived:   mp.bytesReceived,
+		SkippedSends:    mp.skippedSends,
+	}
+	if mp.via != nil {
+		stats.Via = mp.via.String()
+	}
+	if mp.drifts > 0 {
+		stats.MinDrift = float64(mp.minDrift) / float64(time.Millisecond)
+		stats.MaxDrift = float64(mp.maxDrift) / float64(time.Millisecond)
+		stats.AvgDrift = float64(mp.totalDrift) / float64(mp.drifts) / float64(time.Millisecond)
+	}
+	if stats.Sent == 0 {
+		return stats
+	}
+	if stats.StopReason == stopDeadline {
+		// still waiting for these when the deadline cut the run short
+		for _, record := range stats.Packets {
+			if record.Status == statusPending {
+				stats.PendingAtDeadline++
+			}
+		}
+	}
+	if counted := stats.Sent - stats.PendingAtDeadline; mp.excludePending && counted > 0 {
+		stats.Loss = 100 - 100*stats.Received/counted
+	} else if mp.excludePending {
+		stats.LossUndefined = true
+	} else {
+		stats.Loss = 100 - 100*stats.Received/stats.Sent
+	}
+	// the records -stream-stats folded, if any, plus the ones still kept
+	rtts := mp.folded.rtt
+	stats.Errors = mp.folded.errors
+	stats.LostSeqs = append([]int(nil), mp.folded.lostSeqs...)
+	losses := mp.folded.losses
+	for _, record := range stats.Packets {
+		if record.Status == statusError {
+			stats.Errors++
+		}
+		lost := record.Status == statusTimeout || (record.Status == statusPending && !mp.excludePending)
+		if lost {
+			stats.LostSeqs = append(stats.LostSeqs, record.Seq)
+		}
+		mp.addToStreak(&losses, record)
+		if value, ok := mp.rttSample(record); ok {
+			rtts.add(value)
+		}
+	}
+	if rtts.count > 0 {
+		stats.MinRTT = rtts.min
+		stats.MaxRTT = rtts.max
+		stats.AvgRTT = rtts.mean()
+		stats.StddevRTT = rtts.stddev()
+		if mp.histBins > 0 {
+			stats.Histogram = buildHistogram(mp.rttPackets(stats.Packets), mp.histBins, stats.MinRTT, stats.MaxRTT)
+		}
+	}
+	stats.PacketsPerSecond, stats.GoodputEstimate, stats.RTTBoundEstimate =
+		estimateGoodput(mp.packetSize, stats.Received, stats.Elapsed, stats.AvgRTT)
+	stats.Responders = responderStats(mp.folded.responders, stats.Packets, mp.ipAddress.String())
+	stats.MaxLossStreak = losses.longest
+	return stats
+}
+
+// Groups the replies, those -stream-stats folded and those of the packets
+// kept, by the address that sent them, sorted by address, where an empty From
+// stands for the destination. Returns nil when every reply came from the
+// destination.
+func responderStats(folded map[string]responderTotal, packets []PacketRecord, destination string) []ResponderStats {
+	totals := make(map[string]responderTotal)
+	others := false
+	count := func(from string, total responderTotal) {
+		if from == "" {
+			from = destination
+		} else {
+			others = true
+		}
+		t := totals[from]
+		totals[from] = responderTotal{t.replies + total.replies, t.rtt + total.rtt}
+	}
+	for from, total := range folded {
+		count(from, total)
+	}
+	for _, record := range packets {
+		if record.Status == statusReplied {
+			count(record.From, responderTotal{}.add(record.RTT))
+		}
+	}
+	if !others {
+		return nil
+	}
+	responders := make([]ResponderStats, 0, len(totals))
+	for address, total := range totals {
+		responders = append(responders, ResponderStats{
+			Address: address,
+			Replies: total.replies,
+			AvgRTT:  float64(total.rtt) / float64(total.replies) / float64(time.Millisecond),
+		})
+	}
+	sort.Slice(responders, func(i, j int) bool {
+		return responders[i].Address < responders[j].Address
+	})
+	return responders
+}
+
+// Estimates throughput from echoes of payload bytes: the replies per second
+// achieved, the payload bits per second they carried, and the bits per second
+// one payload in flight per average RTT would carry. ICMP echoes don't measure
+// bandwidth, so these are only good for comparing links or runs.
+func estimateGoodput(payload int, received int, elapsed time.Duration, avgRTT float64) (pps float64, goodput float64, rttBound float64) {
+	if received == 0 || elapsed <= 0 {
+		return 0, 0, 0
+	}
+	pps = float64(received) / elapsed.Seconds()
+	goodput = pps * float64(payload) * 8
+	if avgRTT > 0 {
+		rttBound = float64(payload) * 8 / (avgRTT / 1000)
+	}
+	return pps, goodput, rttBound
+}
+
+// Formats a rate in bits per second with a unit that keeps the number short
+func formatBitRate(bps float64) string {
+	switch {
+	case bps >= 1e9:
+		return fmt.Sprintf("%.2f Gbit/s", bps/1e9)
+	case bps >= 1e6:
+		return fmt.Sprintf("%.2f Mbit/s", bps/1e6)
+	case bps >= 1e3:
+		return fmt.Sprintf("%.2f kbit/s", bps/1e3)
+	}
+	return fmt.Sprintf("%.0f bit/s", bps)
+}
+
+// Sorts the RTTs of the answered packets into bins of equal width spanning the
+// observed min to max
+func buildHistogram(packets []PacketRecord, bins int, min float64, max float64) []HistogramBucket {
+	width := (max - min) / float64(bins)
+	if width == 0 {
+		// every sample is the same, one bucket holds them all
+		bins = 1
+	}
+	buckets := make([]HistogramBucket, bins)
+	for i := range buckets {
+		buckets[i].From = min + float64(i)*width
+		buckets[i].To = min + float64(i+1)*width
+	}
+	buckets[bins-1].To = max
+	for _, record := range packets {
+		if record.Status != statusReplied && record.Status != statusRefused {
+			continue
+		}
+		value := float64(record.RTT) / 1000000
+		i := bins - 1
+		if width > 0 && value < max && int((value-min)/width) < bins {
+			i = int((value - min) / width)
+		}
+		buckets[i].Count++
+	}
+	return buckets
+}
+
+// Prints the histogram as one bar per bucket, scaled to the fullest bucket
+func printHistogram(out io.Writer, buckets []HistogramBucket) {
+	const barWidth = 40
+	fullest := 0
+	for _, bucket := range buckets {
+		if bucket.Count > fullest {
+			fullest = bucket.Count
+		}
+	}
+	fmt.Fprintln(out, "rtt histogram:")
+	for _, bucket := range buckets {
+		bar := strings.Repeat("#", bucket.Count*barWidth/fullest)
+		fmt.Fprintf(out, "  %10.3f - %10.3f ms %6d %s\n", bucket.From, bucket.To, bucket.Count, bar)
+	}
+}
+
+// Prints the overall statistics of the current run
+func (mp *MiniPinger) printStats() {
+	// the packet lines still buffered under -flush go first
+	mp.flushOutput()
+	defer mp.flushOutput()
+	stats := mp.stats()
+	if mp.avgOnly {
+		fmt.Fprintln(mp.stdout, formatAvgOnly(stats))
+		// the exit status can hang on it, and stdout holds just the average
+		if mp.expectHops >= 0 {
+			mp.printPathVerdict(os.Stderr, stats)
+		}
+		return
+	}
+	if stats.Sent == 0 {
+		return
+	}
+	out := mp.summaryOutput()
+	if mp.fireAndForget {
+		fmt.Fprintf(out, "%d packets transmitted, no reply tracking, time %d ms \n",
+			stats.Sent, stats.Elapsed/time.Millisecond)
+		return
+	}
+	fmt.Fprintf(out, "%d packets transmitted, %d packets received, %s loss, time %d ms \n",
+		stats.Sent, stats.Received, formatLoss(stats), stats.Elapsed/time.Millisecond)
+	if stats.Via != "" {
+		fmt.Fprintf(out, "source routed via gateway %s\n", stats.Via)
+	}
+	if stats.Errors > 0 {
+		fmt.Fprintf(out, "%d packets answered with ICMP errors\n", stats.Errors)
+	}
+	if stats.RejectedSources > 0 {
+		fmt.Fprintf(out, "%d replies from other addresses than the destination rejected\n", stats.RejectedSources)
+	}
+	if stats.RouterErrors > 0 {
+		fmt.Fprintf(out, "%d ICMP errors from routers accepted unvalidated\n", stats.RouterErrors)
+	}
+	if stats.MaxLossStreak > 0 {
+		fmt.Fprintf(out, "max consecutive loss: %d\n", stats.MaxLossStreak)
+	}
+	if len(stats.Responders) > 0 {
+		fmt.Fprintln(out, "replies by the address they came from:")
+		for _, responder := range stats.Responders {
+			fmt.Fprintf(out, "  %s: %d replies, rtt avg %.3f ms\n", responder.Address, responder.Replies, responder.AvgRTT)
+		}
+	}
+	if mp.ipIDs {
+		fmt.Fprintf(out, "ip id rewritten in %d of %d packets quoted back by ICMP errors\n",
+			stats.IPIDsRewritten, stats.IPIDsChecked)
+	}
+	if mp.verbose {
+		// scheduling jitter of mini-ping itself, as opposed to network jitter
+		fmt.Fprintf(out, "send interval drift min/max/avg: %.3f/%.3f/%.3f ms\n",
+			stats.MinDrift, stats.MaxDrift, stats.AvgDrift)
+		if mp.kernelTimestamps {
+			mp.mu.Lock()
+			fmt.Fprintf(out, "receive timestamps: %d %s, %d %s\n",
+				mp.stampSources[stampSoftware], stampSoftware, mp.stampSources[stampUserspace], stampUserspace)
+			mp.mu.Unlock()
+		}
+	}
+	if stats.SkippedSends > 0 {
+		fmt.Fprintf(out, "%d send slots skipped after falling behind the schedule\n", stats.SkippedSends)
+	}
+	if mp.maxBytes > 0 {
+		fmt.Fprintf(out, "%d bytes sent, %d bytes received\n", stats.BytesSent, stats.BytesReceived)
+	}
+	if mp.goodput && stats.Received > 0 {
+		fmt.Fprintf(out, "goodput estimate (not a bandwidth test): %s at %.1f packets/s, %s with one packet per rtt\n",
+			formatBitRate(stats.GoodputEstimate), stats.PacketsPerSecond, formatBitRate(stats.RTTBoundEstimate))
+	}
+	if stats.PendingAtDeadline > 0 {
+		treatment := "counted as lost"
+		if mp.excludePending {
+			treatment = "excluded from loss"
+		}
+		fmt.Fprintf(out, "%d packets still in flight at the deadline (%s)\n", stats.PendingAtDeadline, treatment)
+	}
+	if mp.showLost && len(stats.LostSeqs) > 0 {
+		seqs := make([]string, len(stats.LostSeqs))
+		for i, seq := range stats.LostSeqs {
+			seqs[i] = strconv.Itoa(seq)
+		}
+		fmt.Fprintf(out, "lost seqs: %s\n", strings.Join(seqs, ","))
+	}
+	if mp.duration > 0 {
+		fmt.Fprintf(out, "(%d of about %d packets expected in %v)\n", stats.Sent, mp.expectedPackets(), mp.duration)
+	}
+	if mp.hasCount() && mp.hasDeadline() {
+		switch stats.StopReason {
+		case stopDeadline:
+			fmt.Fprintf(out, "(stopped by deadline after %d of %d packets)\n", stats.Sent, mp.count)
+		case stopCount:
+			fmt.Fprintf(out, "(all %d packets sent before the deadline)\n", mp.count)
+		}
+	}
+	if stats.Received > 0 {
+		fmt.Fprintf(out, "rtt min/max/avg: %f/%f/%f ms\n",
+			stats.MinRTT, stats.MaxRTT, stats.AvgRTT)
+		if mp.verbose {
+			fmt.Fprintf(out, "rtt stddev: %f ms\n", stats.StddevRTT)
+		}
+		if mp.tcpPort == 0 {
+			fmt.Fprintf(out, "route stability: %d ttl changes observed\n", stats.TTLChanges)
+		}
+		if mp.tos >= 0 {
+			fmt.Fprintf(out, "tos remarked on %d of %d replies\n", stats.TOSRemarked, stats.Received)
+		}
+		if mp.expectTTL > 0 {
+			mp.printInitialTTLs(out)
+		}
+		if mp.showHops {
+			printHopEstimates(out, stats.Packets)
+		}
+		if stats.Drained > 0 {
+			fmt.Fprintf(out, "%d replies received during drain\n", stats.Drained)
+		}
+		if stats.ShortReplies > 0 {
+			fmt.Fprintf(out, "%d replies echoed less than the %d byte payload\n", stats.ShortReplies, mp.packetSize)
+		}
+		if mp.redundancy > 1 {
+			fmt.Fprintf(out, "%d copies of each packet sent, %d of %d copies answered\n",
+				mp.redundancy, stats.Received+stats.Duplicates, stats.Sent*mp.redundancy)
+		} else if stats.Duplicates > 0 {
+			fmt.Fprintf(out, "%d duplicate replies\n", stats.Duplicates)
+		}
+		if stats.Reordered > 0 {
+			note := ""
+			if mp.excludeReordered {
+				note = ", left out of the rtt"
+			}
+			fmt.Fprintf(out, "%d replies out of order%s\n", stats.Reordered, note)
+		}
+		if mp.pattern != "" {
+			fmt.Fprintf(out, "%d replies with a corrupted %s payload pattern\n", stats.Corrupted, mp.pattern)
+		}
+		if len(stats.Histogram) > 0 {
+			printHistogram(out, stats.Histogram)
+		}
+		if value, slow := mp.rttExceeded(stats); slow {
+			fmt.Fprintf(out, "rtt %s %.3f ms exceeds the -maxrtt threshold of %v\n", mp.maxRTTStat, value, mp.maxRTT)
+		}
+	}
+	if mp.expectHops >= 0 {
+		mp.printPathVerdict(out, stats)
+	}
+	if mp.sweepTo > 0 {
+		mp.printSweep(out, stats.Packets)
+	}
+	if mp.timestamp && stats.Received > 0 {
+		printClockOffsets(out, stats)
+	}
+	return
+}
+
+// Prints the hop count -expect-hops checks and whether it is the one expected,
+// which decides exit status 5
+func (mp *MiniPinger) printPathVerdict(out io.Writer, stats Stats) {
+	hops, source, ok := mp.hopCount(stats)
+	if !ok {
+		fmt.Fprintf(out, "path: unknown, no reply tells the hop count, expected %d\n", mp.expectHops)
+		return
+	}
+	verdict := "as expected"
+	if hops != mp.expectHops {
+		verdict = fmt.Sprintf("expected %d", mp.expectHops)
+	}
+	fmt.Fprintf(out, "path: %d hops %s, %s\n", hops, source, verdict)
+}
+
+// Prints the min/avg/max clock offset and one-way delay of the -ts replies
+// that carried standard timestamps, or half the RTT as the one-way delay if
+// none did
+func printClockOffsets(out io.Writer, stats Stats) {
+	var offsets, oneWays []time.Duration
+	for _, record := range stats.Packets {
+		if record.Status == statusReplied && !record.NoTimestamps {
+			offsets = append(offsets, record.Offset)
+			oneWays = append(oneWays, record.OneWay)
+		}
+	}
+	if len(offsets) == 0 {
+		fmt.Fprintf(out, "no standard timestamps in the replies, one-way delay taken as half the rtt: %.3f ms\n", stats.AvgRTT/2)
+		return
+	}
+	fmt.Fprintf(out, "clock offset min/avg/max: %s\n", durationRange(offsets))
+	fmt.Fprintf(out, "one-way delay min/avg/max: %s\n", durationRange(oneWays))
+}
+
+// Formats the minimum, mean and maximum of a non-empty set of durations
+func durationRange(values []time.Duration) string {
+	least, most, total := values[0], values[0], time.Duration(0)
+	for _, value := range values {
+		if value < least {
+			least = value
+		}
+		if value > most {
+			most = value
+		}
+		total += value
+	}
+	return fmt.Sprintf("%v/%v/%v", least, total/time.Duration(len(values)), most)
+}
+
+// Prints which hops answered at each TTL of a -ttl-sweep, from the latest
+// pass over the range that got an answer at that TTL. Each probe of the pass
+// shows its time, or * if it went unanswered, after the address that answered
+// it; routers balancing load can make several addresses answer at one TTL.
+func (mp *MiniPinger) printSweep(out io.Writer, packets []PacketRecord) {
+	addresses := []string{mp.destination().String()}
+	for _, record := range packets {
+		if record.From != "" {
+			addresses = append(addresses, record.From)
+		}
+	}
+	mp.awaitHopNames(addresses, time.Now().Add(hopNameWait))
+	fmt.Fprintln(out, "ttl sweep:")
+	for ttl := mp.sweepFrom; ttl <= mp.sweepTo; ttl++ {
+		passes := make(map[int][]PacketRecord)
+		latest, answered := -1, -1
+		for _, record := range packets {
+			if mp.ttlFor(record.Seq) != ttl {
+				continue
+			}
+			pass := mp.sweepPass(record.Seq)
+			passes[pass] = append(passes[pass], record)
+			if pass > latest {
+				latest = pass
+			}
+			if (record.Status == statusExceeded || record.Status == statusReplied) && pass > answered {
+				answered = pass
+			}
+		}
+		if answered >= 0 {
+			latest = answered
+		}
+		fmt.Fprintf(out, "  ttl %d: %s\n", ttl, mp.hopProbeResults(passes[latest]))
+	}
+}
+
+// Formats the results of the probes sent with one TTL in one pass of a
+// -ttl-sweep, naming the answering address whenever it changes
+func (mp *MiniPinger) hopProbeResults(probes []PacketRecord) string {
+	if len(probes) == 0 {
+		return "*"
+	}
+	var line strings.Builder
+	from := ""
+	for _, record := range probes {
+		switch record.Status {
+		case statusExceeded, statusReplied:
+			hop := mp.hopName(record.From)
+			if record.Status == statusReplied && record.From == "" {
+				hop = mp.hopName(mp.destination().String()) + " (destination)"
+			} else if record.Status == statusReplied {
+				hop += " (answering for the destination)"
+			}
+			if hop != from {
+				fmt.Fprintf(&line, "  %s", hop)
+				from = hop
+			}
+			fmt.Fprintf(&line, "  %v", record.RTT)
+		default:
+			line.WriteString("  *")
+		}
+	}
+	return strings.TrimPrefix(line.String(), "  ")
+}
+
+// Prints how many replies were inferred to start out with each common initial TTL
+func (mp *MiniPinger) printInitialTTLs(out io.Writer) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	var tallies []string
+	for _, initial := range commonInitialTTLs {
+		if n := mp.initialTTLs[initial]; n > 0 {
+			tallies = append(tallies, fmt.Sprintf("%d (%d replies)", initial, n))
+		}
+	}
+	if len(tallies) > 0 {
+		fmt.Fprintf(out, "inferred initial ttl: %s\n", strings.Join(tallies, ", "))
+	}
+}
+
+// Prints how many replies came back over each hop count their TTL implies,
+// fewest hops first
+func printHopEstimates(out io.Writer, packets []PacketRecord) {
+	seen := make(map[int]int)
+	var counts []int
+	for _, record := range packets {
+		if record.Status != statusReplied || record.TTL == 0 {
+			continue
+		}
+		_, hops := inferHops(record.TTL)
+		if seen[hops] == 0 {
+			counts = append(counts, hops)
+		}
+		seen[hops]++
+	}
+	if len(counts) == 0 {
+		return
+	}
+	sort.Ints(counts)
+	tallies := make([]string, len(counts))
+	for i, hops := range counts {
+		tallies[i] = fmt.Sprintf("%d (%d replies)", hops, seen[hops])
+	}
+	fmt.Fprintf(out, "estimated hops: %s\n", strings.Join(tallies, ", "))
+}
+
+// Returns the average RTT for a summary table, or a dash when nothing was
+// answered so a zero doesn't read as an instant reply
+func formatAvgRTT(stats Stats) string {
+	if stats.Received == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.3f ms", stats.AvgRTT)
+}
+
+// Returns the -avg-only summary: the average RTT in milliseconds as a bare
+// number, or NaN when nothing was answered
+func formatAvgOnly(stats Stats) string {
+	if stats.Received == 0 {
+		return "NaN"
+	}
+	return strconv.FormatFloat(stats.AvgRTT, 'f', 3, 64)
+}
+
+// Formats the loss percentage of stats, or N/A when it is undefined
+func formatLoss(stats Stats) string {
+	if stats.LossUndefined {
+		return "N/A"
+	}
+	return fmt.Sprintf("%d%%", stats.Loss)
+}
+
+// Reports whether a -loop session differs enough from the previous one to be
+// worth a summary: loss moved by lossPoints percentage points, the average RTT
+// by rttPercent percent, or the host started or stopped answering
+func summaryChanged(previous Stats, current Stats, lossPoints int, rttPercent float64) bool {
+	if (previous.Received == 0) != (current.Received == 0) {
+		return true
+	}
+	if previous.LossUndefined != current.LossUndefined {
+		return true
+	}
+	lossChange := current.Loss - previous.Loss
+	if lossChange >= lossPoints || -lossChange >= lossPoints {
+		return true
+	}
+	if previous.AvgRTT > 0 && math.Abs(current.AvgRTT-previous.AvgRTT)/previous.AvgRTT*100 >= rttPercent {
+		return true
+	}
+	return false
+}
+
+// Aggregates -maxrtt can be checked against
+const (
+	rttStatAvg = "avg"
+	rttStatMax = "max"
+	rttStatP95 = "p95"
+)
+
+// Returns the RTT aggregate chosen with -maxrtt-stat, in milliseconds, and
+// whether it is above -maxrtt
+func (mp *MiniPinger) rttExceeded(stats Stats) (float64, bool) {
+	if mp.maxRTT <= 0 || stats.Received == 0 {
+		return 0, false
+	}
+	var value float64
+	switch mp.maxRTTStat {
+	case rttStatMax:
+		value = stats.MaxRTT
+	case rttStatP95:
+		value = rttPercentile(mp.rttPackets(stats.Packets), 95)
+	default:
+		value = stats.AvgRTT
+	}
+	return value, value > float64(mp.maxRTT)/float64(time.Millisecond)
+}
+
+// Returns the packets whose RTTs go into the RTT statistics: all of them, or
+// only those answered in order with -exclude-reordered
+func (mp *MiniPinger) rttPackets(packets []PacketRecord) []PacketRecord {
+	if !mp.excludeReordered {
+		return packets
+	}
+	var inOrder []PacketRecord
+	for _, record := range packets {
+		if !record.OutOfOrder {
+			inOrder = append(inOrder, record)
+		}
+	}
+	return inOrder
+}
+
+// Returns the nearest-rank percentile of the RTTs of the answered packets, in milliseconds
+func rttPercentile(packets []PacketRecord, percentile int) float64 {
+	var rtts []float64
+	for _, record := range packets {
+		if record.Status == statusReplied || record.Status == statusRefused {
+			rtts = append(rtts, float64(record.RTT)/float64(time.Millisecond))
+		}
+	}
+	if len(rtts) == 0 {
+		return 0
+	}
+	sort.Float64s(rtts)
+	rank := (percentile*len(rtts) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return rtts[rank-1]
+}
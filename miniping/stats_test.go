@@ -0,0 +1,361 @@
+package miniping
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// Packets sent right before the deadline and still in flight when it passed
+// are counted apart, and -exclude-pending leaves them out of the loss
+func TestPendingAtDeadline(t *testing.T) {
+	tests := []struct {
+		name           string
+		excludePending bool
+		// of four packets sent
+		answered int
+		loss     string
+	}{
+		{"counted as lost", false, 2, "50%"},
+		{"excluded", true, 2, "0%"},
+		{"nothing left to count", true, 0, "N/A"},
+	}
+	for _, tt := range tests {
+		mp := testPinger("192.0.2.1")
+		mp.excludePending = tt.excludePending
+		for seq := 0; seq < 4; seq++ {
+			mp.markSent(seq)
+		}
+		for seq := 0; seq < tt.answered; seq++ {
+			m := &icmp.Message{Type: ipv4.ICMPTypeEchoReply, Body: &icmp.Echo{ID: mp.id, Seq: seq, Data: echoData(mp, seq)}}
+			mp.handleReply(&reply{message: m, numBytes: 64, ttl: 64, receivedAt: time.Now()})
+		}
+		mp.stop(stopDeadline)
+		stats := mp.stats()
+		if want := 4 - tt.answered; stats.PendingAtDeadline != want {
+			t.Errorf("%s: %d pending at the deadline, want %d", tt.name, stats.PendingAtDeadline, want)
+		}
+		if loss := formatLoss(stats); loss != tt.loss {
+			t.Errorf("%s: loss %s, want %s", tt.name, loss, tt.loss)
+		}
+	}
+}
+
+// The sequence numbers never answered are listed in order, to tell a burst
+// of drops from scattered loss
+func TestLostSeqs(t *testing.T) {
+	mp := testPinger("192.0.2.1")
+	mp.jsonl = true
+	mp.showLost = true
+	lost := map[int]bool{3: true, 4: true, 5: true, 17: true}
+	for seq := 0; seq < 20; seq++ {
+		mp.markSent(seq)
+		if lost[seq] {
+			mp.settle(seq, statusTimeout)
+			continue
+		}
+		mp.settle(seq, statusReplied)
+	}
+	if got, want := mp.stats().LostSeqs, []int{3, 4, 5, 17}; !reflect.DeepEqual(got, want) {
+		t.Errorf("lost seqs %v, want %v", got, want)
+	}
+	// -jsonl moves the summary to stderr
+	summary := captureStderr(t, mp.printStats)
+	if !strings.Contains(summary, "lost seqs: 3,4,5,17\n") {
+		t.Errorf("summary %q without the lost seqs", summary)
+	}
+}
+
+// Records answered packets with these RTTs, as if the run had ended
+func injectRTTs(mp *MiniPinger, rtts ...time.Duration) {
+	for seq, rtt := range rtts {
+		mp.packets = append(mp.packets, PacketRecord{Seq: seq, RTT: rtt, Status: statusReplied})
+	}
+	mp.packetsSent = len(rtts)
+	mp.packetsReceived = len(rtts)
+	mp.stopReason = stopCount
+}
+
+func TestMaxRTT(t *testing.T) {
+	ms := time.Millisecond
+	rtts := []time.Duration{10 * ms, 20 * ms, 30 * ms, 40 * ms, 10 * ms, 10 * ms, 10 * ms, 10 * ms, 10 * ms, 10 * ms,
+		10 * ms, 10 * ms, 10 * ms, 10 * ms, 10 * ms, 10 * ms, 10 * ms, 10 * ms, 10 * ms, 90 * ms}
+	tests := []struct {
+		stat   string
+		maxRTT time.Duration
+		want   int
+	}{
+		{rttStatAvg, 20 * ms, exitSuccess},
+		{rttStatAvg, 12 * ms, exitSlow},
+		{rttStatMax, 89 * ms, exitSlow},
+		{rttStatMax, 90 * ms, exitSuccess},
+		{rttStatP95, 40 * ms, exitSuccess},
+		{rttStatP95, 30 * ms, exitSlow},
+		{rttStatAvg, 0, exitSuccess},
+	}
+	for _, tt := range tests {
+		mp := testPinger("192.0.2.1")
+		mp.count = len(rtts)
+		mp.maxRTT = tt.maxRTT
+		mp.maxRTTStat = tt.stat
+		injectRTTs(mp, rtts...)
+		if got := mp.exitCode(mp.stats()); got != tt.want {
+			t.Errorf("%s above %v: exit code %d, want %d", tt.stat, tt.maxRTT, got, tt.want)
+		}
+	}
+}
+
+func TestAllLossStats(t *testing.T) {
+	mp := testPinger("192.0.2.1")
+	mp.packets = []PacketRecord{{Seq: 0, Status: statusTimeout}, {Seq: 1, Status: statusTimeout}}
+	mp.packetsSent = 2
+	mp.stopReason = stopCount
+	stats := mp.stats()
+	if stats.MinRTT != 0 || stats.MaxRTT != 0 || stats.AvgRTT != 0 {
+		t.Errorf("RTTs %v/%v/%v, want zero", stats.MinRTT, stats.MaxRTT, stats.AvgRTT)
+	}
+	if stats.Loss != 100 {
+		t.Errorf("loss %d%%, want 100%%", stats.Loss)
+	}
+	if _, err := json.Marshal(stats); err != nil {
+		t.Errorf("stats don't encode: %v", err)
+	}
+	if got := formatAvgRTT(stats); got != "-" {
+		t.Errorf("average RTT column %q, want a dash", got)
+	}
+}
+
+func TestEstimateGoodput(t *testing.T) {
+	tests := []struct {
+		payload, received      int
+		elapsed                time.Duration
+		avgRTT                 float64
+		pps, goodput, rttBound float64
+	}{
+		// 10 replies a second of 1000 bytes, 8000 bits per 20ms round trip
+		{1000, 100, 10 * time.Second, 20, 10, 80000, 400000},
+		{56, 4, 2 * time.Second, 0, 2, 896, 0},
+		{56, 0, 2 * time.Second, 10, 0, 0, 0},
+		{56, 4, 0, 10, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		pps, goodput, rttBound := estimateGoodput(tt.payload, tt.received, tt.elapsed, tt.avgRTT)
+		if pps != tt.pps || goodput != tt.goodput || rttBound != tt.rttBound {
+			t.Errorf("%d bytes, %d replies in %v at %vms: %v/s, %v bit/s, %v bit/s, want %v, %v and %v", tt.payload, tt.received,
+				tt.elapsed, tt.avgRTT, pps, goodput, rttBound, tt.pps, tt.goodput, tt.rttBound)
+		}
+	}
+}
+
+func TestFormatBitRate(t *testing.T) {
+	for bps, want := range map[float64]string{
+		896: "896 bit/s", 80000: "80.00 kbit/s", 2.5e6: "2.50 Mbit/s", 1e9: "1.00 Gbit/s",
+	} {
+		if got := formatBitRate(bps); got != want {
+			t.Errorf("%v: %q, want %q", bps, got, want)
+		}
+	}
+}
+
+// -stream-stats folds all but the latest records into running aggregates,
+// which agree with the statistics over all the samples
+func TestStreamStatsAgree(t *testing.T) {
+	const packets = 5000
+	run := func(stream bool) Stats {
+		mp := testPinger("192.0.2.1")
+		mp.stdout = io.Discard
+		mp.streamStats = stream
+		// no timers for all those packets
+		mp.fireAndForget = true
+		base := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+		mp.now = func() time.Time {
+			return base
+		}
+		for seq := 0; seq < packets; seq++ {
+			mp.markSent(seq)
+			if seq%7 == 3 {
+				continue
+			}
+			rtt := time.Duration(1000+seq%97*37) * time.Microsecond
+			mp.handleReply(&reply{message: echoReply(mp, seq), receivedAt: base.Add(rtt)})
+		}
+		mp.stop(stopCount)
+		return mp.stats()
+	}
+	full, streamed := run(false), run(true)
+	if len(streamed.Packets) > streamWindow+1 {
+		t.Errorf("%d records kept, want at most %d", len(streamed.Packets), streamWindow+1)
+	}
+	near := func(a, b float64) bool {
+		return math.Abs(a-b) < 1e-6
+	}
+	if streamed.Received != full.Received || !near(streamed.AvgRTT, full.AvgRTT) || !near(streamed.StddevRTT, full.StddevRTT) ||
+		streamed.MinRTT != full.MinRTT || streamed.MaxRTT != full.MaxRTT {
+		t.Errorf("streamed %d replies, rtt min/avg/max/stddev %v/%v/%v/%v; all samples %d, %v/%v/%v/%v",
+			streamed.Received, streamed.MinRTT, streamed.AvgRTT, streamed.MaxRTT, streamed.StddevRTT,
+			full.Received, full.MinRTT, full.AvgRTT, full.MaxRTT, full.StddevRTT)
+	}
+	if !reflect.DeepEqual(streamed.LostSeqs, full.LostSeqs) {
+		t.Errorf("lost %d packets streamed, %d with all records", len(streamed.LostSeqs), len(full.LostSeqs))
+	}
+}
+
+// -avg-only prints the average RTT and nothing else, NaN if nothing came back
+func TestAvgOnly(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		rtts []time.Duration
+		want string
+	}{
+		{[]time.Duration{10 * ms, 20 * ms, 33 * ms}, "21.000\n"},
+		{[]time.Duration{1500 * time.Microsecond}, "1.500\n"},
+		{nil, "NaN\n"},
+	}
+	for _, tt := range tests {
+		mp := testPinger("192.0.2.1")
+		mp.avgOnly = true
+		var out bytes.Buffer
+		mp.stdout = &out
+		injectRTTs(mp, tt.rtts...)
+		if tt.rtts == nil {
+			mp.packetsSent = 2
+			mp.packets = []PacketRecord{{Seq: 0, Status: statusTimeout}, {Seq: 1, Status: statusTimeout}}
+		}
+		mp.printStats()
+		if out.String() != tt.want {
+			t.Errorf("%v: printed %q, want %q", tt.rtts, out.String(), tt.want)
+		}
+	}
+}
+
+// Returns records of replies with the TTLs given, 0 standing for a packet
+// that timed out
+func repliesWithTTLs(ttls ...int) []PacketRecord {
+	var records []PacketRecord
+	for seq, ttl := range ttls {
+		status := statusReplied
+		if ttl == 0 {
+			status = statusTimeout
+		}
+		records = append(records, PacketRecord{Seq: seq, TTL: ttl, Status: status})
+	}
+	return records
+}
+
+// The hop count comes from the reply TTL seen most often, or under
+// -ttl-sweep from the lowest TTL that reached the destination
+func TestHopCount(t *testing.T) {
+	tests := []struct {
+		name string
+		// -ttl-sweep 1 to sweepTo if set
+		sweepTo int
+		packets []PacketRecord
+		hops    int
+		ok      bool
+	}{
+		{"no replies", 0, repliesWithTTLs(0, 0), 0, false},
+		{"the ttl seen most often", 0, repliesWithTTLs(57, 56, 57), 7, true},
+		{"ties go to the shorter path", 0, repliesWithTTLs(56, 57), 7, true},
+		{"timeouts left out", 0, repliesWithTTLs(0, 120, 0), 8, true},
+		{"ttl sweep", 5, []PacketRecord{{Seq: 0, Status: statusTimeout}, {Seq: 2, Status: statusReplied},
+			{Seq: 3, Status: statusReplied}}, 2, true},
+		{"ttl sweep never reaching the destination", 5, repliesWithTTLs(0, 0, 0), -1, false},
+	}
+	for _, tt := range tests {
+		mp := testPinger("192.0.2.1")
+		if tt.sweepTo > 0 {
+			mp.sweepFrom, mp.sweepTo = 1, tt.sweepTo
+		}
+		hops, _, ok := mp.hopCount(Stats{Packets: tt.packets})
+		if hops != tt.hops || ok != tt.ok {
+			t.Errorf("%s: %d hops (%v), want %d (%v)", tt.name, hops, ok, tt.hops, tt.ok)
+		}
+	}
+}
+
+// Loss patterns and the longest loss streak in them, counted as the loss is
+func TestLossStreak(t *testing.T) {
+	const (
+		r = statusReplied
+		l = statusTimeout
+		p = statusPending
+		e = statusError
+	)
+	tests := []struct {
+		name           string
+		statuses       []string
+		excludePending bool
+		want           int
+	}{
+		{"no loss", []string{r, r, r}, false, 0},
+		{"one burst", []string{r, l, l, l, r, l}, false, 3},
+		{"bursts of the same length", []string{l, l, r, l, l}, false, 2},
+		{"an error ends a streak", []string{l, e, l}, false, 1},
+		{"pending counts as lost", []string{r, l, p, p}, false, 3},
+		{"pending left out", []string{r, l, p, p}, true, 1},
+		{"pending left out doesn't end a streak", []string{l, p, l}, true, 2},
+	}
+	for _, tt := range tests {
+		mp := testPinger("192.0.2.1")
+		mp.excludePending = tt.excludePending
+		var streak lossStreak
+		for seq, status := range tt.statuses {
+			record := PacketRecord{Seq: seq, Status: status}
+			mp.addToStreak(&streak, record)
+			mp.packets = append(mp.packets, record)
+		}
+		mp.packetsSent = len(tt.statuses)
+		if streak.longest != tt.want {
+			t.Errorf("%s: longest streak %d, want %d", tt.name, streak.longest, tt.want)
+		}
+		if got := mp.stats().MaxLossStreak; got != tt.want {
+			t.Errorf("%s: summary streak %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+// A loss streak that straddles the records -stream-stats folded and the ones
+// it kept counts as one
+func TestStreamStatsKeepsLossStreak(t *testing.T) {
+	n := streamWindow + 20
+	for _, streamStats := range []bool{false, true} {
+		mp := testPinger("192.0.2.1")
+		mp.streamStats = streamStats
+		mp.mu.Lock()
+		for seq := 0; seq < n; seq++ {
+			status := statusReplied
+			// the first 19 get folded
+			if (seq >= 10 && seq < 25) || (seq >= 100 && seq < 105) {
+				status = statusTimeout
+			}
+			mp.addRecord(PacketRecord{Seq: seq, Status: status})
+		}
+		mp.packetsSent = n
+		mp.mu.Unlock()
+		if got := mp.stats().MaxLossStreak; got != 15 {
+			t.Errorf("stream stats %v: longest streak %d, want 15", streamStats, got)
+		}
+	}
+}
+
+// The summary tallies the replies by their hop estimate, fewest hops first
+func TestPrintHopEstimates(t *testing.T) {
+	var out bytes.Buffer
+	printHopEstimates(&out, repliesWithTTLs(57, 0, 120, 57, 56))
+	if want := "estimated hops: 7 (2 replies), 8 (2 replies)\n"; out.String() != want {
+		t.Errorf("printed %q, want %q", out.String(), want)
+	}
+	out.Reset()
+	printHopEstimates(&out, repliesWithTTLs(0, 0))
+	if out.Len() != 0 {
+		t.Errorf("printed %q without replies", out.String())
+	}
+}